@@ -6,7 +6,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 
 	"github.com/dmitsh/gravitest/pkg/auth"
@@ -18,16 +23,81 @@ const (
 	CmdStatus string = "status"
 	CmdStream string = "stream"
 	CmdStop   string = "stop"
+	CmdPause  string = "pause"
+	CmdResume string = "resume"
+	CmdExec   string = "exec"
+	CmdUpdate string = "update"
+	CmdList   string = "list"
+	CmdShare  string = "share"
+	CmdSignal string = "signal"
 )
 
 var (
+	serverAddr                              string
 	clientCrtPath, clientKeyPath, caCrtPath string
+
+	hostProc bool
+	hostname string
+	network  string
+	user     string
+	groups   string
+	userns   bool
+	rootfs   string
+	mounts   mountList
+	devices  deviceList
+	seccomp  string
+	caps     string
+	rlimits  = rlimitMap{}
+
+	memory        string
+	cpuShares     uint64
+	cpus          float64
+	cpuset        string
+	cpusetMems    string
+	exclusiveCPUs uint
+
+	tty     bool
+	history bool
+	all     bool
+	control bool
+	revoke  bool
 )
 
+var networkModes = map[string]proto.StartProcessRequest_NetworkMode{
+	"none":    proto.StartProcessRequest_NetworkNone,
+	"host":    proto.StartProcessRequest_NetworkHost,
+	"bridged": proto.StartProcessRequest_NetworkBridged,
+}
+
 func init() {
+	flag.StringVar(&serverAddr, "addr", "localhost:12345", "server address")
 	flag.StringVar(&clientCrtPath, "cln.crt", "", "client certificate filepath")
 	flag.StringVar(&clientKeyPath, "cln.key", "", "client key filepath")
 	flag.StringVar(&caCrtPath, "ca.crt", "", "CA certificate path")
+	flag.BoolVar(&hostProc, "host-proc", false, "start: keep the host /proc view inside the job")
+	flag.StringVar(&hostname, "hostname", "", "start: job hostname, a short form of the job UUID by default")
+	flag.StringVar(&network, "net", "none", "start: job network mode (none, host or bridged)")
+	flag.StringVar(&user, "user", "", "start: run the job as uid[:gid], the server policy default if empty")
+	flag.StringVar(&groups, "groups", "", "start: comma separated supplementary group IDs")
+	flag.BoolVar(&userns, "userns", false, "start: run the job in a new user namespace")
+	flag.StringVar(&rootfs, "rootfs", "", "start: job root filesystem: the name[:tag] of an image of the server image directory")
+	flag.Var(&mounts, "mount", "start: bind mount a server path source:target[:ro], repeatable")
+	flag.Var(tmpfsList{&mounts}, "tmpfs", "start: mount a scratch tmpfs target:size[K|M|G], repeatable")
+	flag.Var(&devices, "device", "start: allow the access to a server device path[:rwm], read-write by default, repeatable")
+	flag.StringVar(&caps, "caps", "", "start: comma separated capabilities to add to the default set, e.g. NET_RAW")
+	flag.Var(rlimits, "rlimit", "start: set a resource limit name=value[K|M|G] or name=unlimited (core, cpu, fsize, nofile, stack, as), repeatable")
+	flag.StringVar(&memory, "memory", "", "start, update: memory limit size[K|M|G]")
+	flag.Uint64Var(&cpuShares, "cpu-shares", 0, "start, update: relative CPU weight")
+	flag.Float64Var(&cpus, "cpus", 0, "start, update: hard CPU quota in CPUs, e.g. 0.5")
+	flag.StringVar(&cpuset, "cpuset", "", "start: pin the job to the CPUs, e.g. 0-3,5")
+	flag.StringVar(&cpusetMems, "cpuset-mems", "", "start: pin the job to the memory nodes")
+	flag.UintVar(&exclusiveCPUs, "exclusive-cpus", 0, "start: number of CPUs the server assigns to the job alone")
+	flag.BoolVar(&tty, "tty", false, "exec: run the command on a pseudo-terminal")
+	flag.BoolVar(&history, "history", false, "status: print the job owner and history")
+	flag.BoolVar(&all, "all", false, "list: list the jobs of all the clients")
+	flag.BoolVar(&control, "control", false, "share: grant the control access (stop, signal) instead of the read access (status, stream)")
+	flag.BoolVar(&revoke, "revoke", false, "share: revoke the access of the clients and groups")
+	flag.StringVar(&seccomp, "seccomp", "", "start: seccomp profile name, the built-in \"default\" profile if empty")
 }
 
 func main() {
@@ -59,13 +129,24 @@ func validate() (string, []string, error) {
 			return "", nil, fmt.Errorf("missing CA certificate")
 		}
 	}
+	if _, ok := networkModes[network]; !ok {
+		return "", nil, fmt.Errorf("invalid network mode %q", network)
+	}
+	if len(groups) != 0 && len(user) == 0 {
+		return "", nil, fmt.Errorf("supplementary groups require a user")
+	}
+	if len(memory) != 0 {
+		if _, err := parseSize(memory); err != nil {
+			return "", nil, err
+		}
+	}
 	var cmd string
 	args := []string{}
 
 	for _, arg := range flag.Args() {
 		if len(cmd) == 0 {
 			switch arg {
-			case CmdStart, CmdStatus, CmdStream, CmdStop:
+			case CmdStart, CmdStatus, CmdStream, CmdStop, CmdPause, CmdResume, CmdExec, CmdUpdate, CmdList, CmdShare, CmdSignal:
 				cmd = arg
 			default:
 				return cmd, nil, fmt.Errorf("invalid command %v", arg)
@@ -77,9 +158,29 @@ func validate() (string, []string, error) {
 	if len(cmd) == 0 {
 		return "", nil, fmt.Errorf("missing command")
 	}
-	if len(args) == 0 {
+	if len(args) == 0 && cmd != CmdList {
 		return "", nil, fmt.Errorf("%q command requres arguments", cmd)
 	}
+	if cmd == CmdExec {
+		// exec <id> [--] command [args]
+		if len(args) > 1 && args[1] == "--" {
+			args = append(args[:1], args[2:]...)
+		}
+		if len(args) < 2 {
+			return "", nil, fmt.Errorf("%q command requires a job ID and a command", cmd)
+		}
+	}
+	if cmd == CmdShare && len(args) < 2 {
+		return "", nil, fmt.Errorf("%q command requires a job ID and clients or group:<name> groups", cmd)
+	}
+	if cmd == CmdSignal {
+		if len(args) != 2 {
+			return "", nil, fmt.Errorf("%q command requires a job ID and a signal", cmd)
+		}
+		if _, err := parseSignal(args[1]); err != nil {
+			return "", nil, err
+		}
+	}
 	return cmd, args, nil
 }
 
@@ -89,12 +190,12 @@ func exit(err error) {
 }
 
 func runClient(cmd string, args []string) error {
-	creds, err := auth.GetTLS(clientCrtPath, clientKeyPath, caCrtPath, false)
+	creds, err := auth.GetTLS(clientCrtPath, clientKeyPath, caCrtPath)
 	if err != nil {
 		return err
 	}
 
-	conn, err := grpc.Dial("localhost:12345", grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		return err
 	}
@@ -103,9 +204,39 @@ func runClient(cmd string, args []string) error {
 	ctx := context.Background()
 	client := proto.NewWorkerClient(conn)
 
+	var memoryLimit uint64
+	if len(memory) != 0 {
+		memoryLimit, _ = parseSize(memory)
+	}
+
 	switch cmd {
 	case CmdStart:
-		resp, err := client.StartProcess(ctx, &proto.StartProcessRequest{Path: args[0], Args: args[1:]})
+		jobUser, err := parseUser(user, groups)
+		if err != nil {
+			return err
+		}
+		resp, err := client.StartProcess(ctx, &proto.StartProcessRequest{
+			Path:     args[0],
+			Args:     args[1:],
+			HostProc: hostProc,
+			Hostname: hostname,
+			Network:  networkModes[network],
+			User:     jobUser,
+			Userns:   userns,
+			Rootfs:   rootfs,
+			Mounts:   mounts,
+			Devices:  devices,
+			Seccomp:  seccomp,
+			Caps:     splitList(caps),
+			Rlimits:  rlimits,
+
+			Memory:        memoryLimit,
+			CpuShares:     cpuShares,
+			Cpus:          cpus,
+			Cpuset:        cpuset,
+			CpusetMems:    cpusetMems,
+			ExclusiveCpus: uint32(exclusiveCPUs),
+		})
 		if err != nil {
 			return err
 		}
@@ -116,6 +247,29 @@ func runClient(cmd string, args []string) error {
 			return err
 		}
 		fmt.Println("Done")
+	case CmdPause:
+		_, err := client.PauseProcess(ctx, &proto.JobId{Id: args[0]})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Done")
+	case CmdResume:
+		_, err := client.ResumeProcess(ctx, &proto.JobId{Id: args[0]})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Done")
+	case CmdUpdate:
+		_, err := client.UpdateResources(ctx, &proto.UpdateResourcesRequest{
+			Id:        args[0],
+			Memory:    memoryLimit,
+			CpuShares: cpuShares,
+			Cpus:      cpus,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Done")
 	case CmdStatus:
 		resp, err := client.GetProcessStatus(ctx, &proto.JobId{Id: args[0]})
 		if err != nil {
@@ -128,6 +282,54 @@ func runClient(cmd string, args []string) error {
 			if sig := resp.GetSignal(); sig != 0 {
 				fmt.Println("Signal:", sig)
 			}
+			if resp.GetSeccomp() {
+				fmt.Println("Killed by SIGSYS (likely seccomp)")
+			}
+		}
+		if history {
+			fmt.Println("Owner:", resp.GetOwner())
+			for _, share := range resp.GetShares() {
+				grantee := share.GetGrantee()
+				if share.GetGroup() {
+					grantee = "group " + grantee
+				}
+				fmt.Printf("Shared with %s: %s\n", grantee, share.GetAccess())
+			}
+			fmt.Println("History:")
+			for _, event := range resp.GetHistory() {
+				fmt.Printf("  %s %s: %s\n", time.Unix(event.GetTime(), 0).Format(time.RFC3339), event.GetClientId(), event.GetMessage())
+			}
+		}
+	case CmdShare:
+		req := &proto.ShareRequest{Id: args[0], Revoke: revoke}
+		if control {
+			req.Access = proto.ShareAccess_ShareControl
+		}
+		for _, grantee := range args[1:] {
+			if strings.HasPrefix(grantee, "group:") {
+				req.Groups = append(req.Groups, strings.TrimPrefix(grantee, "group:"))
+			} else {
+				req.Clients = append(req.Clients, grantee)
+			}
+		}
+		if _, err := client.ShareProcess(ctx, req); err != nil {
+			return err
+		}
+		fmt.Println("Done")
+	case CmdSignal:
+		sig, _ := parseSignal(args[1])
+		if _, err := client.SignalProcess(ctx, &proto.SignalRequest{Id: args[0], Signal: int32(sig)}); err != nil {
+			return err
+		}
+		fmt.Println("Done")
+	case CmdList:
+		resp, err := client.ListProcesses(ctx, &proto.ListRequest{All: all})
+		if err != nil {
+			return err
+		}
+		for _, job := range resp.GetProcesses() {
+			fmt.Printf("%s %s %s %s %s\n", job.GetId(), job.GetOwner(), job.GetProcStatus(),
+				time.Unix(job.GetStartTime(), 0).Format(time.RFC3339), strings.Join(job.GetCommand(), " "))
 		}
 	case CmdStream:
 		stream, err := client.StreamOutput(ctx, &proto.JobId{Id: args[0]})
@@ -144,6 +346,199 @@ func runClient(cmd string, args []string) error {
 			}
 			os.Stdout.Write(resp.GetData())
 		}
+	case CmdExec:
+		stream, err := client.ExecInProcess(ctx, &proto.ExecRequest{
+			Id:   args[0],
+			Path: args[1],
+			Args: args[2:],
+			Tty:  tty,
+		})
+		if err != nil {
+			return err
+		}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(resp.GetData())
+			if status := resp.GetStatus(); status != nil {
+				// exit like a shell with the status of the command
+				if sig := status.GetSignal(); sig != 0 {
+					os.Exit(128 + int(sig))
+				}
+				os.Exit(int(status.GetExitStatus()))
+			}
+		}
+	}
+	return nil
+}
+
+// parseSignal converts a signal name, e.g. TERM or SIGTERM, or number.
+func parseSignal(value string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("invalid signal %q", value)
+}
+
+// parseUser converts "uid[:gid]" and a comma separated group list to the job user.
+// An empty user selects the server policy default.
+func parseUser(user, groups string) (*proto.User, error) {
+	if len(user) == 0 {
+		return nil, nil
+	}
+	ids := strings.SplitN(user, ":", 2)
+	uid, err := strconv.ParseUint(ids[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID %q", ids[0])
+	}
+	// the group defaults to the user ID
+	gid := uid
+	if len(ids) == 2 {
+		if gid, err = strconv.ParseUint(ids[1], 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid group ID %q", ids[1])
+		}
+	}
+	jobUser := &proto.User{Uid: uint32(uid), Gid: uint32(gid)}
+	if len(groups) != 0 {
+		for _, item := range strings.Split(groups, ",") {
+			id, err := strconv.ParseUint(item, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group ID %q", item)
+			}
+			jobUser.Groups = append(jobUser.Groups, uint32(id))
+		}
+	}
+	return jobUser, nil
+}
+
+// splitList splits a comma separated list, returning nil for an empty one.
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// mountList collects the repeated -mount flags
+type mountList []*proto.Mount
+
+func (l *mountList) String() string {
+	return ""
+}
+
+func (l *mountList) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro") {
+		return fmt.Errorf("expected source:target[:ro]")
 	}
+	*l = append(*l, &proto.Mount{
+		Type:     proto.Mount_MountBind,
+		Source:   parts[0],
+		Target:   parts[1],
+		ReadOnly: len(parts) == 3,
+	})
 	return nil
 }
+
+// tmpfsList adds the repeated -tmpfs flags to the mount list
+type tmpfsList struct {
+	mounts *mountList
+}
+
+func (l tmpfsList) String() string {
+	return ""
+}
+
+func (l tmpfsList) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected target:size")
+	}
+	size, err := parseSize(parts[1])
+	if err != nil {
+		return err
+	}
+	*l.mounts = append(*l.mounts, &proto.Mount{
+		Type:   proto.Mount_MountTmpfs,
+		Target: parts[0],
+		Size:   size,
+	})
+	return nil
+}
+
+// deviceList collects the repeated -device flags
+type deviceList []*proto.Device
+
+func (l *deviceList) String() string {
+	return ""
+}
+
+func (l *deviceList) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) > 2 {
+		return fmt.Errorf("expected path[:access]")
+	}
+	dev := &proto.Device{Path: parts[0]}
+	if len(parts) == 2 {
+		dev.Access = parts[1]
+	}
+	*l = append(*l, dev)
+	return nil
+}
+
+// rlimitMap collects the repeated -rlimit flags
+type rlimitMap map[string]uint64
+
+func (m rlimitMap) String() string {
+	return ""
+}
+
+func (m rlimitMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected name=value")
+	}
+	if parts[1] == "unlimited" {
+		m[parts[0]] = ^uint64(0)
+		return nil
+	}
+	limit, err := parseSize(parts[1])
+	if err != nil {
+		return err
+	}
+	m[parts[0]] = limit
+	return nil
+}
+
+// parseSize parses a size in bytes with an optional K, M or G suffix.
+func parseSize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+)
+
+// device is a host device node the job may access besides cgroup.DefaultDevices
+type device struct {
+	path   string
+	access string // combination of "r", "w" and "m"
+}
+
+// deviceList collects the repeated -device flags
+type deviceList struct {
+	devices *[]device
+}
+
+func (l deviceList) String() string {
+	return ""
+}
+
+// Set parses "path:access".
+func (l deviceList) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid device %q", value)
+	}
+	*l.devices = append(*l.devices, device{path: parts[0], access: parts[1]})
+	return nil
+}
+
+// setDevices restricts the job cgroup to the default and the requested devices.
+func setDevices(cg *cgroup.Cgroup, opts *options) error {
+	devices := append([]cgroup.Device(nil), cgroup.DefaultDevices...)
+	for _, d := range opts.devices {
+		dev, err := cgroup.DeviceOf(d.path, d.access)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, dev)
+	}
+	return cg.SetDevices(devices)
+}
+
+// mountDevices bind mounts the requested device nodes into the job rootfs.
+func mountDevices(rootfs string, devices []device) error {
+	for _, d := range devices {
+		target := filepath.Join(rootfs, d.path)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount(d.path, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", target, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+)
+
+// enter runs a command in the namespaces and the cgroup of a running job,
+// like nsenter(1), with the credential and the restrictions of the job user command.
+// It reports the command exit status to the engine like the "cgr" stage.
+func enter() error {
+	opts, args, err := parseOptions(os.Args[2:])
+	if err != nil {
+		return err
+	}
+	if opts.target == 0 {
+		return fmt.Errorf("missing target job")
+	}
+
+	// the pseudo-terminal is allocated on the host, as the job may have no /dev/pts
+	var master, slave *os.File
+	if opts.tty {
+		if master, slave, err = openPty(); err != nil {
+			return err
+		}
+		defer master.Close()
+	}
+
+	if err := cgroup.New(args[0]).AddProcess(os.Getpid()); err != nil {
+		return err
+	}
+
+	// the namespaces apply to the calling thread and the processes it creates,
+	// so it must stay locked and never run other goroutines
+	runtime.LockOSThread()
+	mntns, err := os.Open(fmt.Sprintf("/proc/%d/ns/mnt", opts.target))
+	if err != nil {
+		return err
+	}
+	defer mntns.Close()
+	for _, ns := range []struct {
+		name string
+		flag int
+	}{
+		{"ipc", unix.CLONE_NEWIPC},
+		{"uts", unix.CLONE_NEWUTS},
+		{"net", unix.CLONE_NEWNET},
+		{"pid", unix.CLONE_NEWPID},
+	} {
+		if err := setns(fmt.Sprintf("/proc/%d/ns/%s", opts.target, ns.name), ns.flag); err != nil {
+			return err
+		}
+	}
+
+	// the "exec" stage joins the mount namespace itself, as a multithreaded
+	// process can only do it for a thread, which then must exec the command;
+	// the user namespace cannot be joined at all, the job IDs are mapped instead
+	flags := append([]string{}, os.Args[2:len(os.Args)-len(args)]...)
+	flags = append(flags, "-mntns", "3") // the first of cmd.ExtraFiles
+	if opts.usernsSize != 0 {
+		groups := make([]string, 0, len(opts.groups))
+		for _, gid := range opts.groups {
+			groups = append(groups, strconv.FormatUint(uint64(opts.usernsBase+gid), 10))
+		}
+		flags = append(flags,
+			"-uid", strconv.FormatUint(uint64(opts.usernsBase+opts.uid), 10),
+			"-gid", strconv.FormatUint(uint64(opts.usernsBase+opts.gid), 10),
+			"-groups", strings.Join(groups, ","),
+			"-userns-size", "0",
+			// the job capabilities are only granted inside its user namespace
+			"-caps", "", "-ambient", "")
+	}
+
+	cmd := exec.Command("/proc/self/exe", append(append([]string{"exec"}, flags...), args...)...)
+	cmd.ExtraFiles = []*os.File{mntns}
+	// the command stays in the process group of the runner, so the engine
+	// can kill both, while on a terminal it gets a hangup once the runner is gone
+	if opts.tty {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	} else {
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if opts.tty {
+		slave.Close()
+		// the read fails with EIO once the command has closed the terminal
+		io.Copy(os.Stdout, master)
+	}
+	err = cmd.Wait()
+	if cmd.ProcessState == nil {
+		return err
+	}
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	report(status, opts)
+	os.Exit(exitCode(status))
+
+	return nil
+}
+
+// setns joins the calling thread to the namespace.
+func setns(path string, nstype int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Setns(int(f.Fd()), nstype); err != nil {
+		return fmt.Errorf("failed to join %s: %v", path, err)
+	}
+	return nil
+}
+
+// joinMountNamespace joins the calling thread to the mount namespace,
+// which changes its root and working directories to the namespace root.
+func joinMountNamespace(fd int) error {
+	// the thread must not share its filesystem attributes with the other threads
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return fmt.Errorf("failed to unshare filesystem attributes: %v", err)
+	}
+	if err := unix.Setns(fd, unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("failed to join the mount namespace: %v", err)
+	}
+	unix.Close(fd)
+	return unix.Chdir("/")
+}
+
+// openPty opens a new pseudo-terminal pair.
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pseudo-terminal number: %v", err)
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// runInit starts the command and acts as the init process of the job PID
+// namespace until the command terminates: it forwards the catchable signals
+// it receives to the command and reaps all the terminated processes,
+// including the orphans reparented to it. It returns the command wait status.
+func runInit(cmd *exec.Cmd) (syscall.WaitStatus, error) {
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh)
+	defer signal.Stop(sigCh)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+
+	for sig := range sigCh {
+		switch sig {
+		case syscall.SIGCHLD:
+			// several terminations may be reported by a single signal
+			for {
+				var status syscall.WaitStatus
+				wpid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+				if err != nil || wpid <= 0 {
+					break
+				}
+				if wpid == pid {
+					return status, nil
+				}
+			}
+		case syscall.SIGURG:
+			// used by the Go runtime to preempt goroutines
+		default:
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}
+	return 0, nil
+}
+
+// forwardSignals forwards the catchable signals the process receives to pid
+// until the returned function is called.
+func forwardSignals(pid int) func() {
+	sigCh := make(chan os.Signal, 32)
+	signal.Notify(sigCh)
+	go func() {
+		for sig := range sigCh {
+			if sig != syscall.SIGCHLD && sig != syscall.SIGURG {
+				syscall.Kill(pid, sig.(syscall.Signal))
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(sigCh)
+	}
+}
+
+// exitCode converts the wait status to the exit code of a shell,
+// 128 plus the signal number for a killed process.
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
@@ -1,31 +1,101 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"strconv"
+	"runtime"
 	"syscall"
+
+	"github.com/dmitsh/gravitest/pkg/capability"
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+	"github.com/dmitsh/gravitest/pkg/seccomp"
 )
 
-// TODO: use service config for
-// (1) setting CPU and memory resource limits.
-// (2) including block device numbers (currently omitted) and setting associated bandwidth limits
+// TODO: use service config for including block device numbers (currently omitted)
+// and setting associated bandwidth limits
+
+// default resource limits, the engine passes the job ones
 const (
 	cpuShares = 512 // CPU shares
 	rssLimit  = 10  // memory limit with MB
 )
 
+// file descriptors inherited by the "start" and "cgr" stages
+const (
+	reportFd = 3 // pipe to the engine receiving the exit report
+	syncFd   = 4 // pipe closed by "start" once the job network is attached
+)
+
+// options holds the job isolation settings passed by the engine
+// ahead of the cgroup name and the user command.
+type options struct {
+	hostProc bool   // keep the host /proc instead of mounting a private one
+	hostname string // job hostname
+	net      string // network mode
+	bridge   string // bridge to attach to in the bridged mode
+	addr     string // job address in CIDR notation in the bridged mode
+	gateway  string // default gateway in the bridged mode
+
+	uid        uint32   // user ID of the user command
+	gid        uint32   // group ID of the user command
+	groups     []uint32 // supplementary groups of the user command
+	usernsBase uint32   // first host ID mapped into the user namespace
+	usernsSize uint32   // number of IDs mapped into the user namespace, zero disables it
+
+	rootfs string // mount point of the job root filesystem, the host root if empty
+	lower  string // colon separated image layers, topmost first
+	upper  string // writable layer of the job
+	work   string // overlayfs work directory
+	mounts []mount
+
+	devices []device // host devices the job may access besides the default ones
+
+	seccomp string           // seccomp profile: "default" or a JSON profile, unconfined if empty
+	caps    []capability.Cap // capabilities bounding the user command
+	ambient []capability.Cap // capabilities kept by a user command not running as root
+	rlimits []rlimit
+
+	memory    uint64 // memory limit in bytes
+	cpuShares uint64 // relative CPU weight
+	cpuQuota  int64  // CPU time in microseconds per period, zero for no limit
+	cpuPeriod uint64 // CPU quota period in microseconds
+	cpus      string // CPUs the job is pinned to
+	mems      string // memory nodes the job is pinned to
+
+	target int  // "enter" stage: host PID of the init process of the job to enter
+	tty    bool // "enter" stage: run the command on a new pseudo-terminal
+	mntns  int  // "exec" stage: inherited descriptor of the mount namespace to join
+}
+
+// exitReport is written to the report pipe once the user command terminates,
+// as the engine only sees the exit status of the "start" stage.
+type exitReport struct {
+	ExitStatus int  `json:"exitStatus"`
+	Signal     int  `json:"signal,omitempty"`
+	Seccomp    bool `json:"seccomp,omitempty"` // killed by SIGSYS under a seccomp filter, likely by the filter
+}
+
 func main() {
 	var err error
 
+	// keep the engine pipes from leaking into the user command and the helper tools
+	// every stage may run before it uses them; ExtraFiles passes them on explicitly
+	syscall.CloseOnExec(reportFd)
+	syscall.CloseOnExec(syncFd)
+
 	switch os.Args[1] {
 	case "start":
 		err = start()
 	case "cgr":
 		err = cgr()
+	case "exec":
+		err = execute()
+	case "enter":
+		err = enter()
 	default:
 		err = fmt.Errorf("invalid command %q", os.Args[1])
 	}
@@ -34,64 +104,284 @@ func main() {
 	}
 }
 
+// parseOptions parses the runner flags and returns the remaining
+// arguments: the cgroup name followed by the user command.
+func parseOptions(args []string) (*options, []string, error) {
+	opts := &options{}
+
+	fs := flag.NewFlagSet("runner", flag.ContinueOnError)
+	fs.BoolVar(&opts.hostProc, "host-proc", false, "keep the host /proc view")
+	fs.StringVar(&opts.hostname, "hostname", "", "job hostname")
+	fs.StringVar(&opts.net, "net", netHost, "network mode: none, host or bridged")
+	fs.StringVar(&opts.bridge, "bridge", "", "bridge name for the bridged network mode")
+	fs.StringVar(&opts.addr, "addr", "", "job address for the bridged network mode")
+	fs.StringVar(&opts.gateway, "gateway", "", "default gateway for the bridged network mode")
+	uid := fs.Uint("uid", 0, "user ID of the user command")
+	gid := fs.Uint("gid", 0, "group ID of the user command")
+	groups := fs.String("groups", "", "comma separated supplementary group IDs")
+	usernsBase := fs.Uint("userns-base", 0, "first host ID mapped into the user namespace")
+	usernsSize := fs.Uint("userns-size", 0, "number of IDs mapped into the user namespace")
+	fs.StringVar(&opts.rootfs, "rootfs", "", "mount point of the job root filesystem")
+	fs.StringVar(&opts.lower, "lower", "", "colon separated rootfs image layers, topmost first")
+	fs.StringVar(&opts.upper, "upper", "", "writable rootfs layer")
+	fs.StringVar(&opts.work, "work", "", "overlayfs work directory")
+	fs.Var(mountList{mounts: &opts.mounts}, "bind", "bind mount source:target[:ro], repeatable")
+	fs.Var(mountList{mounts: &opts.mounts, tmpfs: true}, "tmpfs", "tmpfs mount target:size, repeatable")
+	fs.Var(deviceList{&opts.devices}, "device", "allow the access to a host device path:access, repeatable")
+	fs.StringVar(&opts.seccomp, "seccomp", "", "seccomp profile: \"default\" or a JSON profile")
+	caps := fs.String("caps", capability.Join(capability.Default), "comma separated capabilities bounding the user command")
+	fs.Uint64Var(&opts.memory, "memory", rssLimit*1024*1024, "memory limit in bytes")
+	fs.Uint64Var(&opts.cpuShares, "cpu-shares", cpuShares, "relative CPU weight")
+	fs.Int64Var(&opts.cpuQuota, "cpu-quota", 0, "CPU time in microseconds per period, zero for no limit")
+	fs.Uint64Var(&opts.cpuPeriod, "cpu-period", cgroup.DefaultCPUPeriod, "CPU quota period in microseconds")
+	fs.StringVar(&opts.cpus, "cpus", "", "CPUs the job is pinned to, e.g. 0-3,5")
+	fs.StringVar(&opts.mems, "mems", "", "memory nodes the job is pinned to")
+	fs.IntVar(&opts.target, "target", 0, "host PID of the init process of the job to enter")
+	fs.BoolVar(&opts.tty, "tty", false, "run the command on a new pseudo-terminal")
+	fs.IntVar(&opts.mntns, "mntns", 0, "descriptor of the mount namespace to join")
+	fs.Var(rlimitList{&opts.rlimits}, "rlimit", "resource limit name=value, repeatable")
+	ambient := fs.String("ambient", "", "comma separated ambient capabilities, a subset of -caps")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	opts.uid, opts.gid = uint32(*uid), uint32(*gid)
+	opts.usernsBase, opts.usernsSize = uint32(*usernsBase), uint32(*usernsSize)
+	var err error
+	if opts.groups, err = parseGroups(*groups); err != nil {
+		return nil, nil, err
+	}
+	if opts.caps, err = capability.ParseList(*caps); err != nil {
+		return nil, nil, err
+	}
+	if opts.ambient, err = capability.ParseList(*ambient); err != nil {
+		return nil, nil, err
+	}
+	for _, c := range opts.ambient {
+		if !containsCap(opts.caps, c) {
+			return nil, nil, fmt.Errorf("ambient %s is not in the capability set", c)
+		}
+	}
+	if !validNetwork(opts.net) {
+		return nil, nil, fmt.Errorf("invalid network mode %q", opts.net)
+	}
+	if opts.net == netBridged && (len(opts.bridge) == 0 || len(opts.addr) == 0 || len(opts.gateway) == 0) {
+		return nil, nil, fmt.Errorf("bridged network mode requires bridge, address and gateway")
+	}
+	if len(opts.rootfs) != 0 && (len(opts.lower) == 0 || len(opts.upper) == 0 || len(opts.work) == 0) {
+		return nil, nil, fmt.Errorf("rootfs requires lower, upper and work directories")
+	}
+	if len(opts.seccomp) != 0 {
+		if _, err := loadProfile(opts.seccomp); err != nil {
+			return nil, nil, err
+		}
+	}
+	if fs.NArg() < 2 {
+		return nil, nil, fmt.Errorf("missing cgroup name or command")
+	}
+	return opts, fs.Args(), nil
+}
+
+func loadProfile(profile string) (*seccomp.Profile, error) {
+	if profile == "default" {
+		return seccomp.Default, nil
+	}
+	return seccomp.Parse([]byte(profile))
+}
+
 func start() error {
+	opts, _, err := parseOptions(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
 	cmd := exec.Command("/proc/self/exe", append([]string{"cgr"}, os.Args[2:]...)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
+	cloneflags := syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if opts.net != netHost {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
+		Cloneflags: uintptr(cloneflags),
+	}
+
+	// pass the report pipe on, and in the bridged mode the sync pipe
+	// the child waits on until its interface is attached
+	cmd.ExtraFiles = []*os.File{reportFile(), nil}
+	var syncR, syncW *os.File
+	if opts.net == netBridged {
+		if syncR, syncW, err = os.Pipe(); err != nil {
+			return err
+		}
+		cmd.ExtraFiles[syncFd-3] = syncR
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if syncW != nil {
+		syncR.Close()
+		if err := attachNetwork(opts, cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		syncW.Close()
 	}
 
-	check(cmd.Run())
+	stop := forwardSignals(cmd.Process.Pid)
+	err = cmd.Wait()
+	stop()
+	check(err)
 
 	return nil
 }
 
 func cgr() error {
-	cgroupName := os.Args[2]
-	cgroupMemDir := filepath.Join("/sys/fs/cgroup/memory", cgroupName)
-	cgroupMemLimitFile := filepath.Join(cgroupMemDir, "memory.limit_in_bytes")
-	cgroupMemProcsFile := filepath.Join(cgroupMemDir, "cgroup.procs")
-
-	cgroupCpuDir := filepath.Join("/sys/fs/cgroup/cpu", cgroupName)
-	cgroupCpuSharesFile := filepath.Join(cgroupCpuDir, "cpu.shares")
-	cgroupCpuProcsFile := filepath.Join(cgroupCpuDir, "cgroup.procs")
+	opts, args, err := parseOptions(os.Args[2:])
+	if err != nil {
+		return err
+	}
 
-	// create cgroup directories
-	if err := os.MkdirAll(cgroupMemDir, 0755); err != nil {
+	cg := cgroup.New(args[0])
+	if err := cg.Create(); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(cgroupCpuDir, 0755); err != nil {
+	if err := cg.Set(&cgroup.Resources{
+		Memory:    opts.memory,
+		CPUShares: opts.cpuShares,
+		CPUQuota:  opts.cpuQuota,
+		CPUPeriod: opts.cpuPeriod,
+		Cpus:      opts.cpus,
+		Mems:      opts.mems,
+	}); err != nil {
 		return err
 	}
-	// set memory limit
-	if err := writeInt(cgroupMemLimitFile, rssLimit*1024*1024); err != nil {
+	if err := setDevices(cg, opts); err != nil {
 		return err
 	}
-	// set CPU shares
-	if err := writeInt(cgroupCpuSharesFile, cpuShares); err != nil {
+	if err := cg.AddProcess(os.Getpid()); err != nil {
 		return err
 	}
-	// set cgroup procs id
-	if err := writeInt(cgroupMemProcsFile, os.Getpid()); err != nil {
+
+	if len(opts.hostname) != 0 {
+		if err := syscall.Sethostname([]byte(opts.hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %v", err)
+		}
+	}
+	// the network is set up first, as it uses the host "ip" tool
+	if err := setupNetwork(opts); err != nil {
 		return err
 	}
-	if err := writeInt(cgroupCpuProcsFile, os.Getpid()); err != nil {
+	if err := setupMounts(opts); err != nil {
 		return err
 	}
 
-	cmd := exec.Command(os.Args[3], os.Args[4:]...)
+	// the user command is run by the "exec" stage, which restricts itself first
+	cmd := exec.Command("/proc/self/exe", append([]string{"exec"}, os.Args[2:]...)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = userAttr(opts)
 
-	check(cmd.Run())
+	// as PID 1 of the job, the runner stays around as its init
+	status, err := runInit(cmd)
+	if err != nil {
+		return err
+	}
+	report(status, opts)
+	os.Exit(exitCode(status))
 
 	return nil
 }
 
-func writeInt(path string, value int) error {
-	return os.WriteFile(path, []byte(strconv.Itoa(value)), 0755)
+// execute applies the restrictions the process has to set on itself,
+// and replaces itself with the user command.
+func execute() error {
+	opts, args, err := parseOptions(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	// the credential and the seccomp filter apply to the calling thread,
+	// which has to be the one calling execve
+	runtime.LockOSThread()
+	if opts.mntns != 0 {
+		if err := joinMountNamespace(opts.mntns); err != nil {
+			return err
+		}
+	}
+	path, err := exec.LookPath(args[1])
+	if err != nil {
+		return err
+	}
+	if err := setRlimits(opts); err != nil {
+		return err
+	}
+	if err := capability.KeepCaps(); err != nil {
+		return err
+	}
+	if err := capability.LimitBounding(opts.caps); err != nil {
+		return err
+	}
+	if err := setUser(opts); err != nil {
+		return err
+	}
+	if err := capability.Set(opts.caps, opts.ambient); err != nil {
+		return err
+	}
+	// setuid binaries and file capabilities must not grant the job more than that
+	if err := capability.NoNewPrivs(); err != nil {
+		return err
+	}
+	if len(opts.seccomp) != 0 {
+		p, err := loadProfile(opts.seccomp)
+		if err != nil {
+			return err
+		}
+		if err := p.Install(); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, args[1:], os.Environ())
+}
+
+// reportFile returns the report pipe, if the engine has provided one.
+func reportFile() *os.File {
+	f := os.NewFile(reportFd, "report")
+	if _, err := f.Stat(); err != nil {
+		return nil
+	}
+	return f
+}
+
+// report sends the exit status of the user command run with the options to the engine.
+func report(status syscall.WaitStatus, opts *options) {
+	f := reportFile()
+	if f == nil {
+		return
+	}
+	defer f.Close()
+
+	r := exitReport{ExitStatus: status.ExitStatus()}
+	if status.Signaled() {
+		r.Signal = int(status.Signal())
+		// the seccomp kill action terminates the process with SIGSYS, which
+		// cannot be told apart from a SIGSYS sent by another process
+		r.Seccomp = status.Signal() == syscall.SIGSYS && len(opts.seccomp) != 0
+	}
+	json.NewEncoder(f).Encode(&r)
+}
+
+func containsCap(caps []capability.Cap, c capability.Cap) bool {
+	for _, item := range caps {
+		if item == c {
+			return true
+		}
+	}
+	return false
 }
 
 func check(err error) {
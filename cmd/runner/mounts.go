@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// devices bind mounted from the host into the /dev of a job rootfs,
+// the ones of cgroup.DefaultDevices
+var rootfsDevices = []string{"null", "zero", "urandom", "tty"}
+
+// mount is a bind mount or a tmpfs requested for the job
+type mount struct {
+	source   string // host path, empty for tmpfs
+	target   string
+	readOnly bool
+	size     uint64 // tmpfs size limit in bytes
+}
+
+// mountList collects the repeated -bind and -tmpfs flags
+type mountList struct {
+	mounts *[]mount
+	tmpfs  bool
+}
+
+func (l mountList) String() string {
+	return ""
+}
+
+// Set parses "source:target[:ro]" for bind mounts and "target:size" for tmpfs.
+func (l mountList) Set(value string) error {
+	parts := strings.Split(value, ":")
+	if l.tmpfs {
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid tmpfs %q", value)
+		}
+		size, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || size == 0 {
+			return fmt.Errorf("invalid tmpfs size %q", parts[1])
+		}
+		*l.mounts = append(*l.mounts, mount{target: parts[0], size: size})
+		return nil
+	}
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro") {
+		return fmt.Errorf("invalid bind mount %q", value)
+	}
+	*l.mounts = append(*l.mounts, mount{source: parts[0], target: parts[1], readOnly: len(parts) == 3})
+	return nil
+}
+
+// setupMounts prepares the job's mount namespace.
+func setupMounts(opts *options) error {
+	// stop mount events from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+	if len(opts.rootfs) != 0 {
+		if err := mountRootfs(opts); err != nil {
+			return err
+		}
+		if err := mountAll(opts.rootfs, opts.mounts); err != nil {
+			return err
+		}
+		return pivotRoot(opts.rootfs, opts.hostProc)
+	}
+	// POSIX shared memory of the job is private to its IPC namespace
+	if err := mountShm("/dev/shm"); err != nil {
+		return err
+	}
+	if err := mountAll("/", opts.mounts); err != nil {
+		return err
+	}
+	if opts.hostProc {
+		return nil
+	}
+	return mountProc("/proc")
+}
+
+// mountAll mounts the job mounts below root. On the host root the targets
+// must exist, while on a job rootfs they are created in the writable layer.
+func mountAll(root string, mounts []mount) error {
+	for _, m := range mounts {
+		target, err := mountTarget(root, m.target)
+		if err != nil {
+			return err
+		}
+		if root != "/" {
+			if err := createTarget(target, m.source); err != nil {
+				return fmt.Errorf("invalid mount target %s: %v", m.target, err)
+			}
+		} else if _, err := os.Stat(target); err != nil {
+			return fmt.Errorf("invalid mount target %s: %v", m.target, err)
+		}
+
+		if len(m.source) == 0 {
+			data := "mode=1777,size=" + strconv.FormatUint(m.size, 10)
+			if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+				return fmt.Errorf("failed to mount tmpfs %s: %v", m.target, err)
+			}
+			continue
+		}
+		if err := syscall.Mount(m.source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %v", m.source, err)
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_NOSUID | syscall.MS_NODEV)
+		if m.readOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("failed to remount %s: %v", m.source, err)
+		}
+	}
+	return nil
+}
+
+// createTarget creates a missing mount target in the job's writable layer.
+// A file can only be bind mounted onto a file, anything else onto a directory.
+func createTarget(target, source string) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if len(source) != 0 {
+		if fi, err := os.Stat(source); err == nil && !fi.IsDir() {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(target, nil, 0644)
+		}
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+// mountTarget returns the target path below root, rejecting paths through
+// symbolic links, which could redirect the mount outside of a job rootfs.
+func mountTarget(root, target string) (string, error) {
+	path := root
+	for _, part := range strings.Split(strings.Trim(filepath.Clean(target), "/"), "/") {
+		if len(part) == 0 {
+			continue
+		}
+		path = filepath.Join(path, part)
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 && root != "/" {
+			return "", fmt.Errorf("mount target %s is a symbolic link", target)
+		}
+	}
+	if path == root {
+		return "", fmt.Errorf("mount target %s is the root directory", target)
+	}
+	return path, nil
+}
+
+// mountProc mounts a procfs showing only the job's PID namespace.
+func mountProc(target string) error {
+	if err := os.MkdirAll(target, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", target, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", target, err)
+	}
+	return nil
+}
+
+// mountRootfs mounts the image layers with the job's writable layer on top,
+// and populates a minimal /dev.
+func mountRootfs(opts *options) error {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", opts.lower, opts.upper, opts.work)
+	if err := syscall.Mount("overlay", opts.rootfs, "overlay", 0, data); err != nil {
+		return fmt.Errorf("failed to mount rootfs: %v", err)
+	}
+
+	dev := filepath.Join(opts.rootfs, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755,size=64k"); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", dev, err)
+	}
+	for _, name := range rootfsDevices {
+		target := filepath.Join(dev, name)
+		if err := os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount(filepath.Join("/dev", name), target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", target, err)
+		}
+	}
+	for name, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	if err := mountDevices(opts.rootfs, opts.devices); err != nil {
+		return err
+	}
+	return mountShm(filepath.Join(dev, "shm"))
+}
+
+// mountShm mounts a tmpfs for the POSIX shared memory of the job.
+func mountShm(target string) error {
+	if err := os.MkdirAll(target, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777,size=64m"); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", target, err)
+	}
+	return nil
+}
+
+// pivotRoot makes root the root filesystem of the job and detaches the host one.
+func pivotRoot(root string, hostProc bool) error {
+	oldRoot := filepath.Join(root, ".oldroot")
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("failed to pivot root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	if hostProc {
+		if err := os.MkdirAll("/proc", 0555); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/.oldroot/proc", "/proc", "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to mount /proc: %v", err)
+		}
+	} else if err := mountProc("/proc"); err != nil {
+		return err
+	}
+
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach the host root: %v", err)
+	}
+	return os.Remove("/.oldroot")
+}
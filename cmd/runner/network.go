@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// network modes, see engine.Network*
+const (
+	netNone    = "none"
+	netHost    = "host"
+	netBridged = "bridged"
+)
+
+// jobInterface is the name of the veth end inside the job's network namespace
+const jobInterface = "eth0"
+
+func validNetwork(mode string) bool {
+	switch mode {
+	case netNone, netHost, netBridged:
+		return true
+	}
+	return false
+}
+
+// attachNetwork creates a veth pair, moves one end into the network namespace
+// of the process pid and plugs the other end into the bridge as an isolated port,
+// which only talks to the bridge, not to the other jobs.
+// It is called by the "start" stage, which remains in the host network namespace.
+func attachNetwork(opts *options, pid int) error {
+	hostIf := "vw" + strconv.Itoa(pid)
+	if err := ip("link", "add", hostIf, "type", "veth", "peer", "name", jobInterface, "netns", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+	if err := ip("link", "set", hostIf, "master", opts.bridge); err != nil {
+		return err
+	}
+	if err := ip("link", "set", hostIf, "type", "bridge_slave", "isolated", "on"); err != nil {
+		return err
+	}
+	return ip("link", "set", hostIf, "up")
+}
+
+// setupNetwork configures the job's network namespace from inside.
+// For the bridged mode it waits for the "start" stage to attach the veth pair.
+func setupNetwork(opts *options) error {
+	if opts.net == netHost {
+		return nil
+	}
+	if err := loopbackUp(); err != nil {
+		return err
+	}
+	if opts.net != netBridged {
+		return nil
+	}
+	// the parent closes the sync pipe once the interface is in place
+	sync := os.NewFile(syncFd, "sync")
+	_, err := io.Copy(io.Discard, sync)
+	sync.Close()
+	if err != nil {
+		return fmt.Errorf("failed to wait for network setup: %v", err)
+	}
+	if err := ip("addr", "add", opts.addr, "dev", jobInterface); err != nil {
+		return err
+	}
+	if err := ip("link", "set", jobInterface, "up"); err != nil {
+		return err
+	}
+	return ip("route", "add", "default", "via", opts.gateway)
+}
+
+// loopbackUp brings up the loopback interface of the current network namespace.
+// The ioctl avoids spawning "ip" on the start path of every isolated job.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return fmt.Errorf("failed to get loopback flags: %v", errno)
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return fmt.Errorf("failed to bring up loopback: %v", errno)
+	}
+	return nil
+}
+
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rlimitResources maps the rlimit names passed by the engine to the setrlimit(2) resources
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// rlimit is a resource limit applied as both the soft and the hard limit
+type rlimit struct {
+	name     string
+	resource int
+	value    uint64
+}
+
+// rlimitList collects the repeated -rlimit flags
+type rlimitList struct {
+	rlimits *[]rlimit
+}
+
+func (l rlimitList) String() string {
+	return ""
+}
+
+// Set parses "name=value", where the value is a number or "unlimited".
+func (l rlimitList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rlimit %q", value)
+	}
+	resource, ok := rlimitResources[parts[0]]
+	if !ok {
+		return fmt.Errorf("unknown rlimit %q", parts[0])
+	}
+	limit := ^uint64(0) // RLIM_INFINITY
+	if parts[1] != "unlimited" {
+		var err error
+		if limit, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return fmt.Errorf("invalid rlimit value %q", parts[1])
+		}
+	}
+	*l.rlimits = append(*l.rlimits, rlimit{name: parts[0], resource: resource, value: limit})
+	return nil
+}
+
+// setRlimits applies the job rlimits to the calling process. It runs
+// as root before the credential switch, so it may raise the hard limits.
+func setRlimits(opts *options) error {
+	for _, r := range opts.rlimits {
+		if err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: r.value, Max: r.value}); err != nil {
+			return fmt.Errorf("failed to set rlimit %s: %v", r.name, err)
+		}
+	}
+	return nil
+}
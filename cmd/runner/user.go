@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseGroups parses a comma separated list of group IDs.
+func parseGroups(list string) ([]uint32, error) {
+	groups := []uint32{}
+	if len(list) == 0 {
+		return groups, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		gid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group ID %q", item)
+		}
+		groups = append(groups, uint32(gid))
+	}
+	return groups, nil
+}
+
+// userAttr returns the process attributes running the "exec" stage,
+// optionally in a new user namespace. It switches to the job credential itself.
+func userAttr(opts *options) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	if opts.usernsSize != 0 {
+		// map the job IDs [0, size) to the host IDs [base, base+size)
+		attr.Cloneflags = syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(opts.usernsBase), Size: int(opts.usernsSize)}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(opts.usernsBase), Size: int(opts.usernsSize)}}
+		attr.GidMappingsEnableSetgroups = true
+		// become the namespace root, as the host root is not mapped into it
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+	return attr
+}
+
+// setUser switches the calling thread to the job credential.
+func setUser(opts *options) error {
+	groups := make([]int, 0, len(opts.groups))
+	for _, gid := range opts.groups {
+		groups = append(groups, int(gid))
+	}
+	if err := unix.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := unix.Setresgid(int(opts.gid), int(opts.gid), int(opts.gid)); err != nil {
+		return fmt.Errorf("failed to set gid: %v", err)
+	}
+	if err := unix.Setresuid(int(opts.uid), int(opts.uid), int(opts.uid)); err != nil {
+		return fmt.Errorf("failed to set uid: %v", err)
+	}
+	return nil
+}
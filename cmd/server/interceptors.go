@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+
+	"github.com/dmitsh/gravitest/pkg/engine"
+	"github.com/dmitsh/gravitest/proto"
+)
+
+// errUnauthenticated is returned for the calls without a client identity
+var errUnauthenticated = errors.New("no client identity")
+
+// rpcPermissions are the permissions of the RPCs; the RPCs not listed are denied
+var rpcPermissions = map[string]int{
+	"StartProcess":     engine.PermStart,
+	"StopProcess":      engine.PermStop,
+	"PauseProcess":     engine.PermPause,
+	"ResumeProcess":    engine.PermResume,
+	"UpdateResources":  engine.PermUpdate,
+	"GetProcessStatus": engine.PermStatus,
+	"ListProcesses":    engine.PermStatus,
+	"ShareProcess":     engine.PermShare,
+	"SignalProcess":    engine.PermStop,
+	"StreamOutput":     engine.PermStream,
+	"ExecInProcess":    engine.PermExec,
+}
+
+// streamRequests create the requests of the server streaming RPCs,
+// which the stream interceptor receives to authorize the calls before their handlers
+var streamRequests = map[string]func() protobuf.Message{
+	"StreamOutput":  func() protobuf.Message { return &proto.JobId{} },
+	"ExecInProcess": func() protobuf.Message { return &proto.ExecRequest{} },
+}
+
+type identityKey struct{}
+
+// clientIdentity returns the client identity the interceptors attached to the context.
+func clientIdentity(ctx context.Context) engine.Identity {
+	id, _ := ctx.Value(identityKey{}).(engine.Identity)
+	return id
+}
+
+// authorize checks the permission of the client to call the RPC with the request,
+// and records the rejected calls in the audit log. It is the only permission check
+// of the API calls; the process manager only checks the ownership of the jobs.
+func (w *WorkerServer) authorize(ctx context.Context, rpc string, id engine.Identity, req interface{}) error {
+	log.Printf("%s: clientID: %s", rpc, id.ID)
+	err := errUnauthenticated
+	if len(id.ID) != 0 {
+		perm, ok := rpcPermissions[rpc]
+		if !ok {
+			err = engine.ErrPermDenied
+		} else {
+			err = w.procManager.CheckPermission(id, perm)
+		}
+		// listing the jobs of all the clients needs the cross-tenant permission too
+		if r, ok := req.(*proto.ListRequest); ok && err == nil && r.GetAll() {
+			err = w.procManager.CheckPermission(id, engine.PermCrossTenant)
+		}
+	}
+	if err != nil {
+		var job string
+		var command []string
+		if r, ok := req.(interface{ GetId() string }); ok {
+			job = r.GetId()
+		}
+		if r, ok := req.(interface {
+			GetPath() string
+			GetArgs() []string
+		}); ok {
+			command = append([]string{r.GetPath()}, r.GetArgs()...)
+		}
+		w.audit(ctx, id, rpc, job, command, err)
+	}
+	return err
+}
+
+// unaryInterceptor authenticates and authorizes the unary calls before their handlers,
+// which find the client identity in their context, and converts the errors to gRPC statuses.
+func (w *WorkerServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := getIdentity(ctx)
+	id.Decision = &engine.Decision{}
+	ctx = context.WithValue(ctx, identityKey{}, id)
+	if err := w.authorize(ctx, path.Base(info.FullMethod), id, req); err != nil {
+		return nil, statusError(err)
+	}
+	resp, err := handler(ctx, req)
+	return resp, statusError(err)
+}
+
+// streamInterceptor authenticates the server streaming calls, receives their request
+// and authorizes them before their handlers, and converts the errors to gRPC statuses.
+func (w *WorkerServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := getIdentity(ss.Context())
+	id.Decision = &engine.Decision{}
+	ctx := context.WithValue(ss.Context(), identityKey{}, id)
+	rpc := path.Base(info.FullMethod)
+	var req protobuf.Message
+	if newRequest, ok := streamRequests[rpc]; ok && len(id.ID) != 0 {
+		req = newRequest()
+		if err := ss.RecvMsg(req); err != nil {
+			return err
+		}
+	}
+	if err := w.authorize(ctx, rpc, id, req); err != nil {
+		return statusError(err)
+	}
+	// the streaming RPCs without a known request are denied
+	if req == nil {
+		return statusError(engine.ErrPermDenied)
+	}
+	return statusError(handler(srv, &authStream{ServerStream: ss, ctx: ctx, req: req}))
+}
+
+// authStream is a server stream passing the request the interceptor received to the handler.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	req protobuf.Message
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authStream) RecvMsg(m interface{}) error {
+	if s.req == nil {
+		return s.ServerStream.RecvMsg(m)
+	}
+	msg, ok := m.(protobuf.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message %T", m)
+	}
+	protobuf.Merge(msg, s.req)
+	s.req = nil
+	return nil
+}
+
+// statusError converts the engine errors to gRPC statuses with the same message,
+// so the clients can tell the errors apart by code.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		code = codes.Unauthenticated
+	case errors.Is(err, engine.ErrPermDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, engine.ErrProcNotFound):
+		code = codes.NotFound
+	case errors.Is(err, engine.ErrInvalidArgument):
+		code = codes.InvalidArgument
+	case errors.Is(err, engine.ErrLimitExceeded), errors.Is(err, engine.ErrNoAddress):
+		code = codes.ResourceExhausted
+	case errors.Is(err, engine.ErrInvalidState):
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
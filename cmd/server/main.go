@@ -3,23 +3,60 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 
+	"github.com/dmitsh/gravitest/pkg/audit"
 	"github.com/dmitsh/gravitest/pkg/auth"
 	"github.com/dmitsh/gravitest/pkg/engine"
+	"github.com/dmitsh/gravitest/pkg/watch"
 	"github.com/dmitsh/gravitest/proto"
 )
 
+var listenAddr, configDir, policyPath, exclusiveCPUs, crlPath, denylistPath string
+var caGrace time.Duration
+var identitySource, trustDomains string
+var auditPath, auditKeyPath, imageDir string
+
+// identityMapper extracts the client IDs from the client certificates
+var identityMapper *auth.IdentityMapper
+
+// fileCheckInterval is how often the policy, revocation and certificate files are checked for changes
+const fileCheckInterval = 2 * time.Second
+
+func init() {
+	flag.StringVar(&listenAddr, "addr", ":12345", "address the server listens on")
+	flag.StringVar(&configDir, "config-dir", "config", "server configuration directory")
+	flag.StringVar(&policyPath, "policy", "", "client policy file in YAML or JSON, <config-dir>/policy.yaml by default")
+	flag.StringVar(&exclusiveCPUs, "exclusive-cpus", "", "CPUs reserved for the jobs requesting exclusive CPUs, e.g. 2-7")
+	flag.StringVar(&crlPath, "crl", "", "certificate revocation list of the CA in PEM or DER")
+	flag.StringVar(&denylistPath, "denylist", "", "denied client certificate serial numbers and SHA-256 fingerprints, <config-dir>/denylist by default")
+	flag.StringVar(&identitySource, "identity", auth.IdentityCN, "client ID of the client certificates: the subject CN (cn), the SPIFFE ID of the URI SAN (uri) or the DNS SAN (dns)")
+	flag.StringVar(&trustDomains, "trust-domains", "", "comma separated trust domains of the uri and dns client IDs, required for uri")
+	flag.StringVar(&auditPath, "audit-log", "/var/log/gravitest/audit.log", "hash chained JSON lines audit log of the API calls")
+	flag.StringVar(&auditKeyPath, "audit-key", "", "secret key file of the HMAC chaining the audit log records, plain SHA-256 hashes if empty")
+	flag.StringVar(&imageDir, "image-dir", "", "directory of the job rootfs images, /var/lib/gravitest/images by default")
+	flag.DurationVar(&caGrace, "ca-grace", 24*time.Hour, "how long the client certificates of the previous CAs are accepted once the CA bundle is rotated")
+}
+
 func main() {
+	flag.Parse()
+	if flag.Arg(0) == "verify-audit" {
+		os.Exit(verifyAudit(flag.Args()[1:]))
+	}
 	err := startServer()
 	if err != nil {
 		log.Printf("failed with error %v\n", err)
@@ -28,23 +65,88 @@ func main() {
 }
 
 func startServer() error {
-	creds, err := auth.GetTLS("certs/server.crt", "certs/server.key", "certs/ca.crt", true)
+	if len(denylistPath) == 0 {
+		denylistPath = filepath.Join(configDir, "denylist")
+	}
+	revocation := &auth.Revocation{CRLPath: crlPath, DenylistPath: denylistPath}
+	domains := []string{}
+	if len(trustDomains) != 0 {
+		domains = strings.Split(trustDomains, ",")
+	}
+	var err error
+	if identityMapper, err = auth.NewIdentityMapper(identitySource, domains); err != nil {
+		return err
+	}
+	serverTLS, err := auth.NewServerTLS("certs/server.crt", "certs/server.key", "certs/ca.crt", caGrace,
+		revocation.VerifyPeerCertificate, identityMapper.VerifyPeerCertificate)
 	if err != nil {
 		return err
 	}
-	server := grpc.NewServer(grpc.Creds(creds))
+	revocation.CAs = serverTLS.CAs
+	if err := revocation.Reload(); err != nil {
+		return err
+	}
 
+	config, err := engine.LoadConfig(configDir)
+	if err != nil {
+		return err
+	}
+	if config.ExclusiveCPUs, err = engine.ParseExclusiveCPUs(exclusiveCPUs); err != nil {
+		return err
+	}
+	config.ImageDir = imageDir
+	if len(policyPath) == 0 {
+		policyPath = filepath.Join(configDir, "policy.yaml")
+	}
+	if config.Policies, err = engine.LoadPolicies(policyPath); err != nil {
+		return err
+	}
+	auditKey, err := loadAuditKey()
+	if err != nil {
+		return err
+	}
+	auditLog, err := audit.Open(auditPath, auditKey)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
 	worker := &WorkerServer{
-		procManager: engine.NewProcManager(),
+		procManager: engine.NewProcManager(config),
+		auditLog:    auditLog,
 	}
+	// the interceptors authenticate and authorize the calls and convert the errors to gRPC statuses
+	server := grpc.NewServer(grpc.Creds(serverTLS.Credentials()),
+		grpc.UnaryInterceptor(worker.unaryInterceptor), grpc.StreamInterceptor(worker.streamInterceptor))
 	proto.RegisterWorkerServer(server, worker)
 
 	stopCh := make(chan os.Signal, 1)
 	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
 
+	// reload the policies, the revocation lists and the certificates on SIGHUP or once the files change
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	watchStop := make(chan struct{})
+	defer close(watchStop)
+	go func() {
+		for range hupCh {
+			reloadPolicies(worker.procManager)
+			reloadRevocation(revocation)
+			if err := serverTLS.Reload(); err != nil {
+				log.Printf("failed to reload the server certificates, keeping the current ones: %v", err)
+			}
+		}
+	}()
+	go watch.Files([]string{policyPath}, fileCheckInterval, watchStop, func() {
+		reloadPolicies(worker.procManager)
+	})
+	go watch.Files(revocation.Paths(), fileCheckInterval, watchStop, func() {
+		reloadRevocation(revocation)
+	})
+	go serverTLS.Watch(fileCheckInterval, watchStop)
+
 	errCh := make(chan error, 1)
 	go func() {
-		l, err := net.Listen("tcp", ":12345")
+		l, err := net.Listen("tcp", listenAddr)
 		if err != nil {
 			errCh <- err
 		}
@@ -64,77 +166,361 @@ func startServer() error {
 	return nil
 }
 
+// reloadPolicies replaces the client policies with the ones of the policy file,
+// keeping the current ones if the file is invalid.
+func reloadPolicies(procManager *engine.ProcManager) {
+	policies, err := engine.LoadPolicies(policyPath)
+	if err != nil {
+		log.Printf("failed to reload policies, keeping the current ones: %v", err)
+		return
+	}
+	procManager.SetPolicies(policies)
+	log.Println("reloaded policies from", policyPath)
+}
+
+// reloadRevocation reloads the CRL and the denylist, keeping the current ones if invalid.
+func reloadRevocation(revocation *auth.Revocation) {
+	if err := revocation.Reload(); err != nil {
+		log.Printf("failed to reload revocation lists, keeping the current ones: %v", err)
+		return
+	}
+	log.Println("reloaded revocation lists")
+}
+
+// minAuditKeySize is the minimal size of the audit log key in bytes
+const minAuditKeySize = 32
+
+// loadAuditKey reads the audit log key, none if no key file is set.
+func loadAuditKey() ([]byte, error) {
+	if len(auditKeyPath) == 0 {
+		return nil, nil
+	}
+	key, err := os.ReadFile(auditKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the audit key: %v", err)
+	}
+	if len(key) < minAuditKeySize {
+		return nil, fmt.Errorf("the audit key %s is shorter than %d bytes", auditKeyPath, minAuditKeySize)
+	}
+	return key, nil
+}
+
+// verifyAudit checks the audit log files and returns the exit status.
+func verifyAudit(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Println("usage: server [-audit-key <file>] verify-audit <file>...")
+		return 2
+	}
+	key, err := loadAuditKey()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	status := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			status = 1
+			continue
+		}
+		last, err := audit.Verify(file, key)
+		file.Close()
+		if err != nil {
+			fmt.Printf("%s: invalid: %v\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: valid, %d records, last hash %s\n", path, last.Seq, last.Hash)
+	}
+	return status
+}
+
 type WorkerServer struct {
 	proto.UnimplementedWorkerServer
 
 	procManager *engine.ProcManager
+	auditLog    *audit.Log
+}
+
+// audit records an API call in the audit log.
+func (w *WorkerServer) audit(ctx context.Context, id engine.Identity, rpc, job string, command []string, err error) {
+	record := audit.Record{
+		ClientID: id.ID,
+		RPC:      rpc,
+		Job:      job,
+		Command:  command,
+		Allowed:  !errors.Is(err, engine.ErrPermDenied) && !errors.Is(err, errUnauthenticated),
+	}
+	if id.Decision != nil {
+		record.Allowed = record.Allowed && !id.Decision.Denied
+		record.CrossTenant, record.Owner = id.Decision.CrossTenant, id.Decision.Owner
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		record.Peer = p.Addr.String()
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := w.auditLog.Append(record); err != nil {
+		log.Printf("failed to write the audit log: %v", err)
+	}
 }
 
 func (w *WorkerServer) StartProcess(ctx context.Context, req *proto.StartProcessRequest) (*proto.JobId, error) {
+	id := clientIdentity(ctx)
+	command := append([]string{req.GetPath()}, req.GetArgs()...)
 	// check that user command is not empty
 	if len(req.GetPath()) == 0 {
-		return &proto.JobId{}, errors.New("no command to run")
+		err := fmt.Errorf("%w: no command to run", engine.ErrInvalidArgument)
+		w.audit(ctx, id, "StartProcess", "", command, err)
+		return &proto.JobId{}, err
 	}
-	clientID := getClientID(ctx)
-	log.Println("StartProcess: clientID:", clientID)
-	uid, err := w.procManager.StartProcess(clientID, req.GetPath(), req.GetArgs()...)
+	uid, err := w.procManager.StartProcess(id, jobOptions(req), req.GetPath(), req.GetArgs()...)
+	w.audit(ctx, id, "StartProcess", uid, command, err)
 	return &proto.JobId{Id: uid}, err
 }
 
 func (w *WorkerServer) StopProcess(ctx context.Context, req *proto.JobId) (*proto.Empty, error) {
-	clientID := getClientID(ctx)
-	log.Println("StopProcess: clientID:", clientID)
-	err := w.procManager.StopProcess(clientID, req.GetId())
+	id := clientIdentity(ctx)
+	err := w.procManager.StopProcess(id, req.GetId())
+	w.audit(ctx, id, "StopProcess", req.GetId(), nil, err)
+	return &proto.Empty{}, err
+}
+
+func (w *WorkerServer) PauseProcess(ctx context.Context, req *proto.JobId) (*proto.Empty, error) {
+	id := clientIdentity(ctx)
+	err := w.procManager.PauseProcess(id, req.GetId())
+	w.audit(ctx, id, "PauseProcess", req.GetId(), nil, err)
+	return &proto.Empty{}, err
+}
+
+func (w *WorkerServer) ResumeProcess(ctx context.Context, req *proto.JobId) (*proto.Empty, error) {
+	id := clientIdentity(ctx)
+	err := w.procManager.ResumeProcess(id, req.GetId())
+	w.audit(ctx, id, "ResumeProcess", req.GetId(), nil, err)
+	return &proto.Empty{}, err
+}
+
+func (w *WorkerServer) UpdateResources(ctx context.Context, req *proto.UpdateResourcesRequest) (*proto.Empty, error) {
+	id := clientIdentity(ctx)
+	err := w.procManager.UpdateResources(id, req.GetId(), engine.Resources{
+		Memory:    req.GetMemory(),
+		CPUShares: req.GetCpuShares(),
+		CPUs:      req.GetCpus(),
+	})
+	w.audit(ctx, id, "UpdateResources", req.GetId(), nil, err)
 	return &proto.Empty{}, err
 }
 
 func (w *WorkerServer) GetProcessStatus(ctx context.Context, req *proto.JobId) (*proto.Status, error) {
-	clientID := getClientID(ctx)
-	log.Println("GetProcessStatus: clientID:", clientID)
-	status, err := w.procManager.StatusProcess(clientID, req.GetId())
+	id := clientIdentity(ctx)
+	status, err := w.procManager.StatusProcess(id, req.GetId())
+	w.audit(ctx, id, "GetProcessStatus", req.GetId(), nil, err)
 	return status, err
 }
 
+func (w *WorkerServer) ListProcesses(ctx context.Context, req *proto.ListRequest) (*proto.ProcessList, error) {
+	id := clientIdentity(ctx)
+	jobs, err := w.procManager.ListProcesses(id, req.GetAll())
+	w.audit(ctx, id, "ListProcesses", "", nil, err)
+	if err != nil {
+		return nil, err
+	}
+	list := &proto.ProcessList{}
+	for _, job := range jobs {
+		list.Processes = append(list.Processes, &proto.ProcessInfo{
+			Id:         job.ID,
+			Owner:      job.Owner,
+			ProcStatus: job.Status,
+			StartTime:  job.StartTime.Unix(),
+			Command:    job.Command,
+		})
+	}
+	return list, nil
+}
+
+func (w *WorkerServer) ShareProcess(ctx context.Context, req *proto.ShareRequest) (*proto.Empty, error) {
+	id := clientIdentity(ctx)
+	err := w.procManager.ShareProcess(id, req.GetId(), engine.Access(req.GetAccess()), req.GetClients(), req.GetGroups(), req.GetRevoke())
+	w.audit(ctx, id, "ShareProcess", req.GetId(), nil, err)
+	return &proto.Empty{}, err
+}
+
+func (w *WorkerServer) SignalProcess(ctx context.Context, req *proto.SignalRequest) (*proto.Empty, error) {
+	id := clientIdentity(ctx)
+	err := w.procManager.SignalProcess(id, req.GetId(), syscall.Signal(req.GetSignal()))
+	w.audit(ctx, id, "SignalProcess", req.GetId(), nil, err)
+	return &proto.Empty{}, err
+}
+
 func (w *WorkerServer) StreamOutput(req *proto.JobId, srv proto.Worker_StreamOutputServer) error {
 	ctx := srv.Context()
-	clientID := getClientID(ctx)
-	log.Println("StreamOutput: clientID:", clientID)
-	reader, err := w.procManager.StreamOutput(clientID, req.GetId())
+	id := clientIdentity(ctx)
+	reader, err := w.procManager.StreamOutput(id, req.GetId())
+	w.audit(ctx, id, "StreamOutput", req.GetId(), nil, err)
 	if err != nil {
 		return err
 	}
+	defer watchClient(ctx, func() { reader.Close() })()
 	data := make([]byte, 512)
 
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			n, err := reader.Read(data)
+		n, err := reader.Read(data)
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if n > 0 {
+			err = srv.Send(&proto.LogData{Data: data[:n]})
 			if err != nil {
-				if err == io.EOF {
-					return nil
-				}
 				return err
 			}
-			if n > 0 {
-				err = srv.Send(&proto.LogData{Data: data[:n]})
-				if err != nil {
-					return err
-				}
-			}
 		}
 	}
 }
 
-func getClientID(ctx context.Context) string {
-	var clientID string
-	if p, ok := peer.FromContext(ctx); ok {
-		if mtls, ok := p.AuthInfo.(credentials.TLSInfo); ok {
-			for _, item := range mtls.State.PeerCertificates {
-				clientID = item.Subject.CommonName
+func (w *WorkerServer) ExecInProcess(req *proto.ExecRequest, srv proto.Worker_ExecInProcessServer) error {
+	ctx := srv.Context()
+	id := clientIdentity(ctx)
+	command := append([]string{req.GetPath()}, req.GetArgs()...)
+	// check that the command is not empty
+	if len(req.GetPath()) == 0 {
+		err := fmt.Errorf("%w: no command to run", engine.ErrInvalidArgument)
+		w.audit(ctx, id, "ExecInProcess", req.GetId(), command, err)
+		return err
+	}
+	execProc, err := w.procManager.ExecInProcess(id, req.GetId(), req.GetTty(), req.GetPath(), req.GetArgs()...)
+	w.audit(ctx, id, "ExecInProcess", req.GetId(), command, err)
+	if err != nil {
+		return err
+	}
+	reader := execProc.Output()
+	// the client is gone: do not leave the command behind
+	defer watchClient(ctx, func() {
+		execProc.Kill()
+		reader.Close()
+	})()
+	data := make([]byte, 512)
+
+	for {
+		n, err := reader.Read(data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
+			if err == io.EOF {
+				return srv.Send(&proto.ExecOutput{Status: execProc.Wait()})
+			}
+			return err
 		}
+		if n > 0 {
+			err = srv.Send(&proto.ExecOutput{Data: data[:n]})
+			if err != nil {
+				execProc.Kill()
+				return err
+			}
+		}
+	}
+}
+
+// watchClient calls gone once the client of the call is gone, as the reads of the
+// output block until the job writes, until the returned function is called.
+func watchClient(ctx context.Context, gone func()) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			gone()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// jobOptions extracts the job isolation settings from the request.
+func jobOptions(req *proto.StartProcessRequest) *engine.JobOptions {
+	opts := &engine.JobOptions{
+		HostProc:      req.GetHostProc(),
+		Hostname:      req.GetHostname(),
+		UserNamespace: req.GetUserns(),
+		Rootfs:        req.GetRootfs(),
+		Seccomp:       req.GetSeccomp(),
+		Capabilities:  req.GetCaps(),
+		Rlimits:       req.GetRlimits(),
+		Memory:        req.GetMemory(),
+		CPUShares:     req.GetCpuShares(),
+		CPUs:          req.GetCpus(),
+		CPUSet:        req.GetCpuset(),
+		MemSet:        req.GetCpusetMems(),
+		ExclusiveCPUs: int(req.GetExclusiveCpus()),
+	}
+	if user := req.GetUser(); user != nil {
+		opts.User = &engine.User{
+			UID:    user.GetUid(),
+			GID:    user.GetGid(),
+			Groups: user.GetGroups(),
+		}
+	}
+	for _, mount := range req.GetMounts() {
+		m := engine.Mount{
+			Type:     engine.MountBind,
+			Source:   mount.GetSource(),
+			Target:   mount.GetTarget(),
+			ReadOnly: mount.GetReadOnly(),
+			Size:     mount.GetSize(),
+		}
+		if mount.GetType() == proto.Mount_MountTmpfs {
+			m.Type = engine.MountTmpfs
+		}
+		opts.Mounts = append(opts.Mounts, m)
+	}
+	for _, dev := range req.GetDevices() {
+		opts.Devices = append(opts.Devices, engine.Device{
+			Path:   dev.GetPath(),
+			Access: dev.GetAccess(),
+		})
+	}
+	switch req.GetNetwork() {
+	case proto.StartProcessRequest_NetworkNone:
+		opts.Network = engine.NetworkNone
+	case proto.StartProcessRequest_NetworkHost:
+		opts.Network = engine.NetworkHost
+	case proto.StartProcessRequest_NetworkBridged:
+		opts.Network = engine.NetworkBridged
+	}
+	return opts
+}
+
+// getIdentity returns the identity of the client certificate: the client ID of the identity mapper,
+// the organizations and organizational units as its groups and its SANs.
+func getIdentity(ctx context.Context) engine.Identity {
+	var id engine.Identity
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return id
+	}
+	mtls, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(mtls.State.PeerCertificates) == 0 {
+		return id
+	}
+	cert := mtls.State.PeerCertificates[0]
+	clientID, err := identityMapper.ClientID(cert)
+	if err != nil {
+		// the TLS handshake rejects the certificates without a client ID
+		log.Printf("invalid client identity: %v", err)
+		return id
+	}
+	id.ID = clientID
+	id.Groups = append(append(id.Groups, cert.Subject.Organization...), cert.Subject.OrganizationalUnit...)
+	id.SANs = append(append(id.SANs, cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		id.SANs = append(id.SANs, uri.String())
 	}
-	return clientID
+	return id
 }
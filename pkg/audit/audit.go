@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is an entry of the audit log.
+type Record struct {
+	// Seq numbers the records from 1
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// ClientID is the client calling the API
+	ClientID string `json:"clientId"`
+	// Peer is the client network address
+	Peer    string   `json:"peer,omitempty"`
+	RPC     string   `json:"rpc"`
+	Job     string   `json:"job,omitempty"`
+	Command []string `json:"command,omitempty"`
+	// Allowed is false when the call is denied by the authorization
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+	// CrossTenant flags the access to a job of another client, the Owner
+	CrossTenant bool   `json:"crossTenant,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	// PrevHash is the Hash of the previous record, empty for the first one
+	PrevHash string `json:"prevHash"`
+	// Hash is the HMAC-SHA256 with the log key, or the SHA-256 without a key,
+	// of PrevHash and of the record without Hash in JSON
+	Hash string `json:"hash"`
+}
+
+// hash computes the record hash.
+func (r Record) hash(key []byte) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if len(key) != 0 {
+		h = hmac.New(sha256.New, key)
+	}
+	h.Write([]byte(r.PrevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Log is an append-only JSON lines file of hash chained records, so the records
+// cannot be modified, removed or reordered without breaking the chain.
+// Without a key anyone able to write the file can recompute the chain, so it only
+// detects accidental corruption; with a secret key the records cannot be forged
+// without the key.
+type Log struct {
+	mutex    sync.Mutex
+	file     *os.File
+	key      []byte
+	seq      uint64
+	lastHash string
+}
+
+// Open verifies the log file with the key, if any, and opens it to append
+// the records that follow, creating it if it does not exist.
+func Open(path string, key []byte) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := Verify(file, key)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid audit log %s: %v", path, err)
+	}
+	return &Log{file: file, key: key, seq: last.Seq, lastHash: last.Hash}, nil
+}
+
+// Append chains and writes the record, setting its Seq, PrevHash and Hash,
+// and its Time if not set.
+func (l *Log) Append(r Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+	r.Seq, r.PrevHash = l.seq+1, l.lastHash
+	var err error
+	if r.Hash, err = r.hash(l.key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq, l.lastHash = r.Seq, r.Hash
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// Verify checks the records of a log and their chain with the key of the log, if any,
+// and returns the last record. It reports the first line that is invalid, modified
+// or out of sequence.
+func Verify(reader io.Reader, key []byte) (Record, error) {
+	last := Record{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		r := Record{}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&r); err != nil {
+			return last, fmt.Errorf("line %d: invalid record: %v", n, err)
+		}
+		if r.Seq != last.Seq+1 {
+			return last, fmt.Errorf("line %d: record %d follows record %d", n, r.Seq, last.Seq)
+		}
+		if r.PrevHash != last.Hash {
+			return last, fmt.Errorf("line %d: record %d is not chained to record %d", n, r.Seq, last.Seq)
+		}
+		hash, err := r.hash(key)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %v", n, err)
+		}
+		if hash != r.Hash {
+			return last, fmt.Errorf("line %d: record %d has been modified", n, r.Seq)
+		}
+		last = r
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	return last, nil
+}
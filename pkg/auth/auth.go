@@ -3,6 +3,7 @@ package auth
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
@@ -10,26 +11,33 @@ import (
 	"google.golang.org/grpc/credentials"
 )
 
-func GetTLS(crt, key, caCrt string, isServer bool) (credentials.TransportCredentials, error) {
+// GetTLS returns the mTLS credentials of the client, which trusts the server certificates
+// signed by the CAs of the caCrt bundle. The server uses ServerTLS.
+func GetTLS(crt, key, caCrt string) (credentials.TransportCredentials, error) {
 	certificate, err := tls.LoadX509KeyPair(crt, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load certificate: %v", err)
 	}
 
-	ca, err := os.ReadFile(caCrt)
+	cas, err := loadCAs(caCrt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+		return nil, err
 	}
-
 	capool := x509.NewCertPool()
-	if !capool.AppendCertsFromPEM(ca) {
-		return nil, errors.New("failed to add ca certificate")
+	for _, ca := range cas {
+		capool.AddCert(ca)
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{certificate},
-		ClientCAs:    capool,
+	tlsConfig := newConfig()
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+	tlsConfig.RootCAs = capool
+
+	return credentials.NewTLS(tlsConfig), nil
+}
 
+// newConfig returns the TLS settings common to the server and the client.
+func newConfig() *tls.Config {
+	return &tls.Config{
 		MinVersion: tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
@@ -43,12 +51,31 @@ func GetTLS(crt, key, caCrt string, isServer bool) (credentials.TransportCredent
 		},
 		PreferServerCipherSuites: true,
 	}
-	if isServer {
-		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		tlsConfig.ClientCAs = capool
-	} else {
-		tlsConfig.RootCAs = capool
-	}
+}
 
-	return credentials.NewTLS(tlsConfig), nil
+// loadCAs reads the certificates of a PEM CA bundle.
+func loadCAs(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+	}
+	cas := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA certificate %s: %v", path, err)
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, errors.New("failed to add ca certificate")
+	}
+	return cas, nil
 }
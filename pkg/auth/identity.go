@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// identity sources
+const (
+	// IdentityCN is the subject common name
+	IdentityCN = "cn"
+	// IdentityURI is the SPIFFE ID of the URI SAN, e.g. spiffe://corp/ns/ci/sa/builder
+	IdentityURI = "uri"
+	// IdentityDNS is the first DNS SAN
+	IdentityDNS = "dns"
+)
+
+// IdentityMapper extracts the client ID from the client certificates.
+type IdentityMapper struct {
+	// Source is IdentityCN, IdentityURI or IdentityDNS
+	Source string
+	// TrustDomains are the accepted SPIFFE trust domains of the URI identities,
+	// or the accepted domains of the DNS identities, any if empty
+	TrustDomains []string
+}
+
+// NewIdentityMapper validates the identity source and the trust domains.
+// The URI identities require trust domains.
+func NewIdentityMapper(source string, trustDomains []string) (*IdentityMapper, error) {
+	switch source {
+	case IdentityCN:
+		if len(trustDomains) != 0 {
+			return nil, errors.New("trust domains apply to the uri and dns identities")
+		}
+	case IdentityURI:
+		if len(trustDomains) == 0 {
+			return nil, errors.New("uri identities require trust domains")
+		}
+	case IdentityDNS:
+	default:
+		return nil, fmt.Errorf("invalid identity source %q", source)
+	}
+	domains := []string{}
+	for _, domain := range trustDomains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if !validDomain(domain) {
+			return nil, fmt.Errorf("invalid trust domain %q", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return &IdentityMapper{Source: source, TrustDomains: domains}, nil
+}
+
+// ClientID returns the client ID of the certificate.
+func (m *IdentityMapper) ClientID(cert *x509.Certificate) (string, error) {
+	switch m.Source {
+	case IdentityURI:
+		return m.spiffeID(cert)
+	case IdentityDNS:
+		if len(cert.DNSNames) == 0 {
+			return "", errors.New("no DNS SAN")
+		}
+		name := strings.ToLower(strings.TrimSuffix(cert.DNSNames[0], "."))
+		if !m.trusted(name, true) {
+			return "", fmt.Errorf("DNS SAN %q is not in a trust domain", name)
+		}
+		return name, nil
+	}
+	if len(cert.Subject.CommonName) == 0 {
+		return "", errors.New("no CN")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// VerifyPeerCertificate is the tls.Config hook rejecting the client certificates
+// without a valid identity.
+func (m *IdentityMapper) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	if _, err := m.ClientID(verifiedChains[0][0]); err != nil {
+		return fmt.Errorf("invalid client identity: %v", err)
+	}
+	return nil
+}
+
+// spiffeID returns the SPIFFE ID of the certificate, which must hold exactly one.
+func (m *IdentityMapper) spiffeID(cert *x509.Certificate) (string, error) {
+	var id *url.URL
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if id != nil {
+			return "", errors.New("several SPIFFE IDs")
+		}
+		id = uri
+	}
+	if id == nil {
+		return "", errors.New("no SPIFFE ID")
+	}
+	if err := validateSPIFFEID(id); err != nil {
+		return "", fmt.Errorf("invalid SPIFFE ID %q: %v", id, err)
+	}
+	if !m.trusted(id.Host, false) {
+		return "", fmt.Errorf("SPIFFE ID %q is not in a trust domain", id)
+	}
+	return id.String(), nil
+}
+
+// validateSPIFFEID checks the SPIFFE ID of a workload: a trust domain and a path
+// of non empty segments of letters, digits, '.', '-' and '_', other than "." and "..".
+func validateSPIFFEID(id *url.URL) error {
+	if id.User != nil || len(id.Port()) != 0 || len(id.RawQuery) != 0 || len(id.Fragment) != 0 || id.ForceQuery {
+		return errors.New("user info, port, query and fragment are not allowed")
+	}
+	if !validDomain(id.Host) || id.Host != strings.ToLower(id.Host) {
+		return errors.New("invalid trust domain")
+	}
+	if len(id.Path) == 0 || len(id.RawPath) != 0 {
+		return errors.New("invalid path")
+	}
+	for _, segment := range strings.Split(id.Path[1:], "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." || strings.Trim(segment, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_") != "" {
+			return fmt.Errorf("invalid path segment %q", segment)
+		}
+	}
+	return nil
+}
+
+// trusted reports whether the domain is a trust domain, or a subdomain of one
+// if subdomains are allowed.
+func (m *IdentityMapper) trusted(domain string, subdomains bool) bool {
+	if len(m.TrustDomains) == 0 {
+		return true
+	}
+	for _, trustDomain := range m.TrustDomains {
+		if domain == trustDomain || (subdomains && strings.HasSuffix(domain, "."+trustDomain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validDomain(domain string) bool {
+	return len(domain) != 0 && len(domain) <= 255 && strings.Trim(domain, "abcdefghijklmnopqrstuvwxyz0123456789.-_") == ""
+}
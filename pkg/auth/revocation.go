@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revocation rejects the client certificates revoked by a CRL of the CA
+// or listed in a local denylist. Reload picks up the changes of the files,
+// the new lists apply to the connections that follow.
+type Revocation struct {
+	// CRLPath is the CRL file in PEM or DER, none if empty
+	CRLPath string
+	// DenylistPath lists a certificate per line by SHA-256 fingerprint, or by serial number
+	// followed by " issuer=" and the issuer name in RFC 2253 format. The fingerprints and
+	// the serial numbers are in hex, optionally separated by colons and prefixed with
+	// "Fingerprint=" or "serial=" as printed by openssl; '#' starts a comment.
+	// A missing file is an empty denylist.
+	DenylistPath string
+	// CAs returns the CAs which may sign the CRL, the CAs of the accepted client certificates
+	// such as ServerTLS.CAs, so a previous CA may still revoke its certificates during the grace period
+	CAs func() []*x509.Certificate
+
+	mutex sync.RWMutex
+	// CA certificate signing the CRL, nil if none
+	crlCA *x509.Certificate
+	// revoked serial numbers of the CRL
+	revoked map[serialKey]bool
+	// denied serial numbers of the denylist
+	denied map[serialKey]bool
+	// denied fingerprints of the denylist
+	deniedFingerprints map[string]bool
+}
+
+// serialKey identifies a certificate by its issuer and serial number,
+// as the serial numbers are only unique per issuer.
+type serialKey struct {
+	issuer string
+	serial string
+}
+
+func certSerialKey(cert *x509.Certificate) serialKey {
+	return serialKey{issuer: cert.Issuer.String(), serial: formatSerial(cert.SerialNumber)}
+}
+
+// Reload reads the CRL and the denylist, keeping the current lists if either is invalid.
+func (r *Revocation) Reload() error {
+	var crlCA *x509.Certificate
+	revoked := map[serialKey]bool{}
+	if len(r.CRLPath) != 0 {
+		var err error
+		if crlCA, revoked, err = loadCRL(r.CRLPath, r.CAs()); err != nil {
+			return err
+		}
+	}
+	denied, fingerprints, err := loadDenylist(r.DenylistPath)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.crlCA, r.revoked = crlCA, revoked
+	r.denied, r.deniedFingerprints = denied, fingerprints
+	return nil
+}
+
+// Paths returns the files to watch for changes.
+func (r *Revocation) Paths() []string {
+	paths := []string{}
+	for _, path := range []string{r.CRLPath, r.DenylistPath} {
+		if len(path) != 0 {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// VerifyPeerCertificate is the tls.Config hook rejecting the revoked certificates
+// of the verified chains, the CA certificates included. The CRL only applies
+// to the certificates issued by the CA signing it.
+func (r *Revocation) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, chain := range verifiedChains {
+		for i, cert := range chain {
+			key := certSerialKey(cert)
+			// the last certificate of the chain is the self-signed root
+			issuer := cert
+			if i+1 < len(chain) {
+				issuer = chain[i+1]
+			}
+			if r.crlCA != nil && issuer.Equal(r.crlCA) && r.revoked[key] {
+				return fmt.Errorf("certificate %s of %q is revoked", key.serial, cert.Subject.CommonName)
+			}
+			fingerprint := sha256.Sum256(cert.Raw)
+			if r.denied[key] || r.deniedFingerprints[hex.EncodeToString(fingerprint[:])] {
+				return fmt.Errorf("certificate %s of %q is denied", key.serial, cert.Subject.CommonName)
+			}
+		}
+	}
+	return nil
+}
+
+// loadCRL returns the CA of cas signing a CRL and the revoked serial numbers of the CRL.
+func loadCRL(path string, cas []*x509.Certificate) (*x509.Certificate, map[serialKey]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CRL: %v", err)
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CRL %s: %v", path, err)
+	}
+	// any accepted CA may sign the CRL while the CA is rotated
+	var signer *x509.Certificate
+	err = errors.New("no accepted CA")
+	for _, ca := range cas {
+		if err = ca.CheckCRLSignature(crl); err == nil {
+			signer = ca
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CRL %s: %v", path, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		// an outdated CRL still lists the certificates revoked so far
+		log.Printf("CRL %s has expired on %s", path, crl.TBSCertList.NextUpdate)
+	}
+	revoked := map[serialKey]bool{}
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[serialKey{issuer: signer.Subject.String(), serial: formatSerial(cert.SerialNumber)}] = true
+	}
+	return signer, revoked, nil
+}
+
+// loadDenylist returns the normalized serial number and fingerprint entries of the denylist.
+func loadDenylist(path string) (map[serialKey]bool, map[string]bool, error) {
+	denied, fingerprints := map[serialKey]bool{}, map[string]bool{}
+	if len(path) == 0 {
+		return denied, fingerprints, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return denied, fingerprints, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load denylist: %v", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(line) == 0 {
+			continue
+		}
+		var issuer string
+		if i := strings.Index(line, " issuer="); i != -1 {
+			issuer = strings.TrimSpace(line[i+len(" issuer="):])
+			line = strings.TrimSpace(line[:i])
+		}
+		if i := strings.LastIndex(line, "="); i != -1 {
+			line = strings.TrimSpace(line[i+1:])
+		}
+		entry := strings.ToLower(strings.ReplaceAll(line, ":", ""))
+		value, ok := new(big.Int).SetString(entry, 16)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s:%d: invalid serial number or fingerprint %q", path, n, line)
+		}
+		switch {
+		case len(entry) == sha256.Size*2:
+			fingerprints[entry] = true
+		case len(issuer) == 0:
+			return nil, nil, fmt.Errorf("%s:%d: serial number %q without issuer", path, n, line)
+		default:
+			denied[serialKey{issuer: issuer, serial: formatSerial(value)}] = true
+		}
+	}
+	return denied, fingerprints, nil
+}
+
+// formatSerial formats a serial number in lower case hex without leading zeros.
+func formatSerial(serial *big.Int) string {
+	return serial.Text(16)
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+
+	"github.com/dmitsh/gravitest/pkg/watch"
+)
+
+// ServerTLS serves the server certificate and the client CAs of the files to every
+// new connection, so they can be rotated without restarting the server.
+// Once the CA bundle changes, the client certificates signed by the CAs it no longer
+// contains are still accepted for the grace period, so the clients can be moved
+// to the new CA one by one.
+type ServerTLS struct {
+	crt, key, caCrt string
+	caGrace         time.Duration
+	verifiers       []VerifyFunc
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	cas         []*x509.Certificate
+	// previous CAs accepted until graceEnd
+	previousCAs []*x509.Certificate
+	graceEnd    time.Time
+}
+
+// VerifyFunc is a tls.Config.VerifyPeerCertificate hook, e.g. Revocation.VerifyPeerCertificate.
+type VerifyFunc func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// NewServerTLS loads the server certificate, key and CA bundle. The server rejects
+// the client certificates any of the verifiers rejects.
+func NewServerTLS(crt, key, caCrt string, caGrace time.Duration, verifiers ...VerifyFunc) (*ServerTLS, error) {
+	s := &ServerTLS{crt: crt, key: key, caCrt: caCrt, caGrace: caGrace, verifiers: verifiers}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the files, keeping the current certificate and CAs if they are invalid,
+// e.g. when the certificate is replaced and the key is not yet.
+func (s *ServerTLS) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(s.crt, s.key)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	cas, err := loadCAs(s.caCrt)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certificate = &certificate
+	if removed := missingCAs(s.cas, cas); len(removed) != 0 {
+		if time.Now().Before(s.graceEnd) {
+			removed = append(removed, missingCAs(s.previousCAs, cas)...)
+		}
+		s.previousCAs, s.graceEnd = removed, time.Now().Add(s.caGrace)
+		log.Printf("CA bundle rotated, accepting %d previous CA certificates until %s", len(removed), s.graceEnd.Format(time.RFC3339))
+	}
+	s.cas = cas
+	return nil
+}
+
+// missingCAs returns the CAs of old that are not in cas.
+func missingCAs(old, cas []*x509.Certificate) []*x509.Certificate {
+	missing := []*x509.Certificate{}
+	for _, ca := range old {
+		found := false
+		for _, c := range cas {
+			if ca.Equal(c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ca)
+		}
+	}
+	return missing
+}
+
+// Paths returns the files to watch for changes.
+func (s *ServerTLS) Paths() []string {
+	return []string{s.crt, s.key, s.caCrt}
+}
+
+// Watch reloads the files once they change until stop is closed.
+func (s *ServerTLS) Watch(interval time.Duration, stop <-chan struct{}) {
+	watch.Files(s.Paths(), interval, stop, func() {
+		if err := s.Reload(); err != nil {
+			log.Printf("failed to reload the server certificates, keeping the current ones: %v", err)
+			return
+		}
+		log.Println("reloaded the server certificates")
+	})
+}
+
+// Credentials returns the gRPC server credentials.
+func (s *ServerTLS) Credentials() credentials.TransportCredentials {
+	tlsConfig := newConfig()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.GetConfigForClient = s.getConfigForClient
+	return credentials.NewTLS(tlsConfig)
+}
+
+// CAs returns the CAs of the accepted client certificates: the CAs of the bundle,
+// and the previous CAs during the grace period.
+func (s *ServerTLS) CAs() []*x509.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	cas := append([]*x509.Certificate{}, s.cas...)
+	if time.Now().Before(s.graceEnd) {
+		cas = append(cas, s.previousCAs...)
+	}
+	return cas
+}
+
+// getConfigForClient returns the TLS settings of a new connection
+// with the current certificate and client CAs.
+func (s *ServerTLS) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	capool := x509.NewCertPool()
+	for _, ca := range s.CAs() {
+		capool.AddCert(ca)
+	}
+	s.mutex.RLock()
+	certificate := s.certificate
+	s.mutex.RUnlock()
+
+	tlsConfig := newConfig()
+	// HTTP/2 as negotiated by the gRPC credentials for the base settings
+	tlsConfig.NextProtos = []string{"h2"}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = capool
+	tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certificate, nil
+	}
+	tlsConfig.VerifyPeerCertificate = s.verifyPeerCertificate
+	return tlsConfig, nil
+}
+
+// verifyPeerCertificate runs the verifiers on the verified client certificate chains.
+func (s *ServerTLS) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, verify := range s.verifiers {
+		if err := verify(rawCerts, verifiedChains); err != nil {
+			log.Printf("rejected client certificate: %v", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package capability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cap is a Linux capability number, see capabilities(7).
+type Cap uint
+
+// names maps the capability names to their numbers, see <linux/capability.h>
+var names = map[string]Cap{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// Default is the minimal set of capabilities the jobs running as root keep:
+// managing the ownership and permissions of their files, signalling their
+// processes, switching users and binding privileged ports.
+var Default = []Cap{
+	names["CAP_CHOWN"],
+	names["CAP_DAC_OVERRIDE"],
+	names["CAP_FOWNER"],
+	names["CAP_FSETID"],
+	names["CAP_KILL"],
+	names["CAP_SETGID"],
+	names["CAP_SETUID"],
+	names["CAP_NET_BIND_SERVICE"],
+}
+
+// Parse converts a capability name, with or without the "CAP_" prefix
+// and in any case, to its number.
+func Parse(name string) (Cap, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	c, ok := names[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown capability %q", name)
+	}
+	return c, nil
+}
+
+// ParseList parses a comma separated list of capability names.
+func ParseList(list string) ([]Cap, error) {
+	caps := []Cap{}
+	if len(list) == 0 {
+		return caps, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		c, err := Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+func (c Cap) String() string {
+	for name, n := range names {
+		if n == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("CAP_%d", uint(c))
+}
+
+// Join formats the capabilities as a sorted comma separated list of names.
+func Join(caps []Cap) string {
+	list := make([]string, 0, len(caps))
+	for _, c := range caps {
+		list = append(list, c.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// The functions below change the capabilities of the calling thread only.
+// The caller must lock it with runtime.LockOSThread and exec right after,
+// so the user command inherits the thread credential.
+
+// KeepCaps keeps the permitted capabilities of the thread across
+// the switch from root to another user.
+func KeepCaps() error {
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to keep capabilities: %v", err)
+	}
+	return nil
+}
+
+// LimitBounding drops all the capabilities but caps from the bounding set,
+// which caps the capabilities the thread and the programs it runs may ever gain.
+func LimitBounding(caps []Cap) error {
+	for c := Cap(0); ; c++ {
+		if contains(caps, c) {
+			continue
+		}
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err == syscall.EINVAL {
+			// past the last capability supported by the kernel
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to drop %s from the bounding set: %v", c, err)
+		}
+	}
+}
+
+// Set reduces the effective, permitted and inheritable sets of the thread to caps,
+// and raises the ambient capabilities, which a program run by a user other
+// than root keeps across execve(2). Ambient capabilities must be a subset of caps.
+func Set(caps, ambient []Cap) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	for _, c := range caps {
+		data[c/32].Effective |= 1 << (c % 32)
+		data[c/32].Permitted |= 1 << (c % 32)
+		data[c/32].Inheritable |= 1 << (c % 32)
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %v", err)
+	}
+	for _, c := range ambient {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("failed to raise ambient %s: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// NoNewPrivs stops the thread and the programs it runs from gaining privileges
+// through setuid, setgid and file capabilities on execve(2).
+func NoNewPrivs() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+	return nil
+}
+
+func contains(caps []Cap, c Cap) bool {
+	for _, item := range caps {
+		if item == c {
+			return true
+		}
+	}
+	return false
+}
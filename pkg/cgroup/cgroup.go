@@ -0,0 +1,274 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Root is the mount point of the cgroup hierarchies.
+const Root = "/sys/fs/cgroup"
+
+// DefaultCPUPeriod is the CFS period the CPU quota is applied over, in microseconds.
+const DefaultCPUPeriod = 100000
+
+// v1Controllers are the cgroup v1 hierarchies a job cgroup is created in
+var v1Controllers = []string{"memory", "cpu", "cpuset", "freezer", "devices"}
+
+// Resources are the limits applied to a job cgroup. Zero values leave
+// the corresponding limits unchanged.
+type Resources struct {
+	// Memory limits the job memory usage in bytes
+	Memory uint64
+	// CPUShares is the relative CPU weight, converted to cpu.weight on cgroup v2
+	CPUShares uint64
+	// CPUQuota is the CPU time in microseconds the job may use per CPUPeriod, -1 for no limit
+	CPUQuota int64
+	// CPUPeriod is the CPU quota period in microseconds, DefaultCPUPeriod if zero
+	CPUPeriod uint64
+	// Cpus and Mems are the CPUs and memory nodes the job is pinned to, in the "0-3,5" list format
+	Cpus string
+	Mems string
+}
+
+// Cgroup is a job cgroup, either in the cgroup v1 hierarchies
+// or in the cgroup v2 unified hierarchy.
+type Cgroup struct {
+	name string
+	v2   bool
+}
+
+// New returns the cgroup named name, detecting the cgroup version of the host.
+func New(name string) *Cgroup {
+	return &Cgroup{name: name, v2: IsV2()}
+}
+
+// IsV2 reports whether the host uses the cgroup v2 unified hierarchy.
+func IsV2() bool {
+	_, err := os.Stat(filepath.Join(Root, "cgroup.controllers"))
+	return err == nil
+}
+
+// path returns the cgroup directory in the controller hierarchy, ignored on cgroup v2.
+func (c *Cgroup) path(controller string) string {
+	if c.v2 {
+		return filepath.Join(Root, c.name)
+	}
+	return filepath.Join(Root, controller, c.name)
+}
+
+// Create creates the cgroup directories.
+func (c *Cgroup) Create() error {
+	if c.v2 {
+		// make the controllers available to the job cgroup
+		if err := write(filepath.Join(Root, "cgroup.subtree_control"), "+cpu +cpuset +memory"); err != nil {
+			return err
+		}
+		return os.MkdirAll(c.path(""), 0755)
+	}
+	for _, controller := range v1Controllers {
+		if err := os.MkdirAll(c.path(controller), 0755); err != nil {
+			return err
+		}
+	}
+	// a cgroup v1 cpuset accepts no tasks until its CPUs and memory nodes are set
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		if value, err := read(filepath.Join(c.path("cpuset"), file)); err == nil && len(value) != 0 {
+			continue
+		}
+		value, err := read(filepath.Join(Root, "cpuset", file))
+		if err != nil {
+			return err
+		}
+		if err := write(filepath.Join(c.path("cpuset"), file), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set applies the resource limits to the cgroup.
+func (c *Cgroup) Set(r *Resources) error {
+	if c.v2 {
+		return c.setV2(r)
+	}
+	return c.setV1(r)
+}
+
+func (c *Cgroup) setV1(r *Resources) error {
+	if r.Memory != 0 {
+		if err := writeUint(filepath.Join(c.path("memory"), "memory.limit_in_bytes"), r.Memory); err != nil {
+			return err
+		}
+	}
+	if r.CPUShares != 0 {
+		if err := writeUint(filepath.Join(c.path("cpu"), "cpu.shares"), r.CPUShares); err != nil {
+			return err
+		}
+	}
+	if r.CPUQuota != 0 {
+		period := r.CPUPeriod
+		if period == 0 {
+			period = DefaultCPUPeriod
+		}
+		if err := writeUint(filepath.Join(c.path("cpu"), "cpu.cfs_period_us"), period); err != nil {
+			return err
+		}
+		if err := write(filepath.Join(c.path("cpu"), "cpu.cfs_quota_us"), strconv.FormatInt(r.CPUQuota, 10)); err != nil {
+			return err
+		}
+	}
+	return c.setCpuset(r)
+}
+
+func (c *Cgroup) setV2(r *Resources) error {
+	if r.Memory != 0 {
+		if err := writeUint(filepath.Join(c.path(""), "memory.max"), r.Memory); err != nil {
+			return err
+		}
+	}
+	if r.CPUShares != 0 {
+		// map the v1 shares range [2, 262144] to the v2 weight range [1, 10000]
+		weight := 1 + ((r.CPUShares-2)*9999)/262142
+		if err := writeUint(filepath.Join(c.path(""), "cpu.weight"), weight); err != nil {
+			return err
+		}
+	}
+	if r.CPUQuota != 0 {
+		period := r.CPUPeriod
+		if period == 0 {
+			period = DefaultCPUPeriod
+		}
+		quota := "max"
+		if r.CPUQuota > 0 {
+			quota = strconv.FormatInt(r.CPUQuota, 10)
+		}
+		if err := write(filepath.Join(c.path(""), "cpu.max"), fmt.Sprintf("%s %d", quota, period)); err != nil {
+			return err
+		}
+	}
+	return c.setCpuset(r)
+}
+
+func (c *Cgroup) setCpuset(r *Resources) error {
+	// the memory nodes go first, so the CPUs never run without them
+	if len(r.Mems) != 0 {
+		if err := write(filepath.Join(c.path("cpuset"), "cpuset.mems"), r.Mems); err != nil {
+			return err
+		}
+	}
+	if len(r.Cpus) != 0 {
+		if err := write(filepath.Join(c.path("cpuset"), "cpuset.cpus"), r.Cpus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddProcess moves the process into the cgroup.
+func (c *Cgroup) AddProcess(pid int) error {
+	if c.v2 {
+		return writeUint(filepath.Join(c.path(""), "cgroup.procs"), uint64(pid))
+	}
+	for _, controller := range v1Controllers {
+		if err := writeUint(filepath.Join(c.path(controller), "cgroup.procs"), uint64(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Processes returns the PIDs of the processes of the cgroup.
+func (c *Cgroup) Processes() ([]int, error) {
+	path := filepath.Join(c.path(v1Controllers[0]), "cgroup.procs")
+	if c.v2 {
+		path = filepath.Join(c.path(""), "cgroup.procs")
+	}
+	data, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, field := range strings.Fields(data) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID %q in %s", field, path)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// freezeTimeout bounds the wait for all the cgroup processes to stop
+const freezeTimeout = 5 * time.Second
+
+// Freeze stops all the processes of the cgroup until Thaw is called,
+// and waits for them to be stopped.
+func (c *Cgroup) Freeze() error {
+	if c.v2 {
+		if err := write(filepath.Join(c.path(""), "cgroup.freeze"), "1"); err != nil {
+			return err
+		}
+		return c.waitState(filepath.Join(c.path(""), "cgroup.events"), "frozen 1")
+	}
+	state := filepath.Join(c.path("freezer"), "freezer.state")
+	if err := write(state, "FROZEN"); err != nil {
+		return err
+	}
+	if err := c.waitState(state, "FROZEN"); err != nil {
+		// do not leave the cgroup half frozen
+		write(state, "THAWED")
+		return err
+	}
+	return nil
+}
+
+// Thaw resumes the processes of a frozen cgroup.
+func (c *Cgroup) Thaw() error {
+	if c.v2 {
+		return write(filepath.Join(c.path(""), "cgroup.freeze"), "0")
+	}
+	return write(filepath.Join(c.path("freezer"), "freezer.state"), "THAWED")
+}
+
+// waitState polls the file until it contains the line.
+func (c *Cgroup) waitState(path, line string) error {
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		data, err := read(path)
+		if err != nil {
+			return err
+		}
+		for _, l := range strings.Split(data, "\n") {
+			if l == line {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %q in %s", line, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func read(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func write(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+func writeUint(path string, value uint64) error {
+	return write(path, strconv.FormatUint(value, 10))
+}
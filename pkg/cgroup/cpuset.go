@@ -0,0 +1,81 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxListID is the largest CPU or memory node number, the CONFIG_NR_CPUS limit of the kernel
+const MaxListID = 8191
+
+// ParseList parses a CPU or memory node list in the "0-3,5" format
+// into sorted unique numbers, none larger than MaxListID.
+func ParseList(list string) ([]int, error) {
+	seen := map[int]bool{}
+	ids := []int{}
+	if len(strings.TrimSpace(list)) == 0 {
+		return ids, nil
+	}
+	for _, item := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 || first > MaxListID {
+			return nil, fmt.Errorf("invalid list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first || last > MaxListID {
+				return nil, fmt.Errorf("invalid list %q", list)
+			}
+		}
+		for id := first; id <= last; id++ {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// FormatList formats the numbers in the "0-3,5" list format.
+func FormatList(ids []int) string {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// OnlineCPUs returns the CPUs of the host available to the jobs.
+func OnlineCPUs() ([]int, error) {
+	return readList("/sys/devices/system/cpu/online")
+}
+
+// OnlineMems returns the memory nodes of the host available to the jobs.
+func OnlineMems() ([]int, error) {
+	return readList("/sys/devices/system/node/online")
+}
+
+func readList(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseList(string(data))
+}
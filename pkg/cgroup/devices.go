@@ -0,0 +1,262 @@
+package cgroup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Wildcard matches any device major or minor number.
+const Wildcard = -1
+
+// Device is a device access rule of a cgroup.
+type Device struct {
+	// Type is 'c' for character and 'b' for block devices
+	Type  byte
+	Major int64
+	Minor int64
+	// Access is a combination of 'r' (read), 'w' (write) and 'm' (mknod)
+	Access string
+}
+
+// DefaultDevices are the devices every job may access: /dev/null, /dev/zero,
+// /dev/urandom and the terminals, i.e. /dev/tty, /dev/ptmx and /dev/pts/*.
+var DefaultDevices = []Device{
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm"},
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm"},
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm"},
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm"},
+	{Type: 'c', Major: 136, Minor: Wildcard, Access: "rwm"},
+}
+
+// DeviceOf returns the rule allowing the access to the device node.
+func DeviceOf(path, access string) (Device, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return Device{}, fmt.Errorf("invalid device %s: %v", path, err)
+	}
+	dev := Device{
+		Major:  int64(unix.Major(st.Rdev)),
+		Minor:  int64(unix.Minor(st.Rdev)),
+		Access: access,
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		dev.Type = 'c'
+	case unix.S_IFBLK:
+		dev.Type = 'b'
+	default:
+		return Device{}, fmt.Errorf("%s is not a device", path)
+	}
+	return dev, dev.Validate()
+}
+
+// Validate checks the device type and access.
+func (d Device) Validate() error {
+	if d.Type != 'c' && d.Type != 'b' {
+		return fmt.Errorf("invalid device type %q", d.Type)
+	}
+	if len(d.Access) == 0 || strings.Trim(d.Access, "rwm") != "" {
+		return fmt.Errorf("invalid device access %q", d.Access)
+	}
+	return nil
+}
+
+// String formats the rule as written to the cgroup v1 devices.allow, e.g. "c 136:* rwm".
+func (d Device) String() string {
+	return fmt.Sprintf("%c %s:%s %s", d.Type, formatDevNumber(d.Major), formatDevNumber(d.Minor), d.Access)
+}
+
+func formatDevNumber(n int64) string {
+	if n == Wildcard {
+		return "*"
+	}
+	return fmt.Sprint(n)
+}
+
+// SetDevices denies the cgroup processes the access to all the devices but the listed ones,
+// with the devices controller on cgroup v1 and a BPF device program on cgroup v2.
+// The restriction applies when a device is opened or created.
+func (c *Cgroup) SetDevices(devices []Device) error {
+	for _, dev := range devices {
+		if err := dev.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.v2 {
+		return attachDeviceProgram(c.path(""), deviceProgram(devices))
+	}
+	if err := write(filepath.Join(c.path("devices"), "devices.deny"), "a"); err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		if err := write(filepath.Join(c.path("devices"), "devices.allow"), dev.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BPF device program context, see struct bpf_cgroup_dev_ctx in <linux/bpf.h>
+const (
+	devTypeBlock = 1
+	devTypeChar  = 2
+
+	devAccessMknod = 1
+	devAccessRead  = 2
+	devAccessWrite = 4
+
+	// offsets of the access_type, major and minor fields
+	offsetAccessType = 0
+	offsetMajor      = 4
+	offsetMinor      = 8
+)
+
+// eBPF instruction opcodes, see <linux/bpf.h>
+const (
+	opLoadWord = unix.BPF_LDX | unix.BPF_W | unix.BPF_MEM
+	opAnd      = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+	opRsh      = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+	opMov      = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	opMovReg   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	opJne      = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	opJneReg   = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+	opExit     = unix.BPF_JMP | unix.BPF_EXIT
+)
+
+// bpfInsn is struct bpf_insn.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination register in the low and source register in the high nibble
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// deviceProgram compiles the rules to a BPF_PROG_TYPE_CGROUP_DEVICE program,
+// which returns 1 to allow the access and 0 to deny it.
+func deviceProgram(devices []Device) []bpfInsn {
+	// R1 is the context: R2 = device type, R3 = access, R4 = major, R5 = minor
+	prog := []bpfInsn{
+		insn(opLoadWord, 2, 1, offsetAccessType, 0),
+		insn(opAnd, 2, 0, 0, 0xffff),
+		insn(opLoadWord, 3, 1, offsetAccessType, 0),
+		insn(opRsh, 3, 0, 0, 16),
+		insn(opLoadWord, 4, 1, offsetMajor, 0),
+		insn(opLoadWord, 5, 1, offsetMinor, 0),
+	}
+	for _, dev := range devices {
+		devType := int32(devTypeChar)
+		if dev.Type == 'b' {
+			devType = devTypeBlock
+		}
+		var access int32
+		for _, a := range dev.Access {
+			switch a {
+			case 'm':
+				access |= devAccessMknod
+			case 'r':
+				access |= devAccessRead
+			case 'w':
+				access |= devAccessWrite
+			}
+		}
+		// the jumps to the next rule are fixed up once the rule length is known
+		rule := []bpfInsn{insn(opJne, 2, 0, 0, devType)}
+		if access != devAccessMknod|devAccessRead|devAccessWrite {
+			// the requested access must be a subset of the allowed one
+			rule = append(rule,
+				insn(opMovReg, 1, 3, 0, 0),
+				insn(opAnd, 1, 0, 0, access),
+				insn(opJneReg, 1, 3, 0, 0))
+		}
+		if dev.Major != Wildcard {
+			rule = append(rule, insn(opJne, 4, 0, 0, int32(dev.Major)))
+		}
+		if dev.Minor != Wildcard {
+			rule = append(rule, insn(opJne, 5, 0, 0, int32(dev.Minor)))
+		}
+		rule = append(rule, insn(opMov, 0, 0, 0, 1), insn(opExit, 0, 0, 0, 0))
+		for i := range rule {
+			if rule[i].code == opJne || rule[i].code == opJneReg {
+				rule[i].off = int16(len(rule) - i - 1)
+			}
+		}
+		prog = append(prog, rule...)
+	}
+	return append(prog, insn(opMov, 0, 0, 0, 0), insn(opExit, 0, 0, 0, 0))
+}
+
+// bpfProgLoadAttr is the BPF_PROG_LOAD part of union bpf_attr.
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+}
+
+// bpfProgAttachAttr is the BPF_PROG_ATTACH part of union bpf_attr.
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// attachDeviceProgram loads the program and attaches it to the cgroup directory,
+// replacing the program attached before, if any.
+func attachDeviceProgram(dir string, prog []bpfInsn) error {
+	insns := make([]byte, 0, len(prog)*8)
+	for _, ins := range prog {
+		insns = append(insns, ins.code, ins.regs, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint16(insns[len(insns)-6:], uint16(ins.off))
+		binary.LittleEndian.PutUint32(insns[len(insns)-4:], uint32(ins.imm))
+	}
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 4096)
+	load := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return fmt.Errorf("failed to load device program: %v: %s", errno, strings.TrimRight(string(logBuf), "\x00"))
+	}
+	defer unix.Close(int(fd))
+
+	cgroup, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cgroup.Close()
+	attach := bpfProgAttachAttr{
+		targetFd:    uint32(cgroup.Fd()),
+		attachBpfFd: uint32(fd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attach)), unsafe.Sizeof(attach)); errno != 0 {
+		return fmt.Errorf("failed to attach device program to %s: %v", dir, errno)
+	}
+	return nil
+}
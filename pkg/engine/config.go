@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the server side settings of the engine.
+type Config struct {
+	// ConfigDir holds the server configuration files, such as the "seccomp" profiles directory
+	ConfigDir string
+	// Rlimits holds the default and maximum values of the job rlimits
+	Rlimits map[string]RlimitRange
+	// ImageDir holds the rootfs images of the jobs, <data dir>/images by default
+	ImageDir string
+	// ExclusiveCPUs are reserved for the jobs requesting exclusive CPUs, see ParseExclusiveCPUs
+	ExclusiveCPUs []int
+	// Policies is the initial policy table, see LoadPolicies
+	Policies *Policies
+}
+
+// LoadConfig reads the engine settings from the configuration directory.
+// The optional "rlimits.json" file overrides DefaultRlimits per resource:
+//
+//	{"core": {"default": 0, "max": 1073741824}, "cpu": {"default": "unlimited", "max": "unlimited"}}
+func LoadConfig(dir string) (Config, error) {
+	config := Config{
+		ConfigDir: dir,
+		Rlimits:   map[string]RlimitRange{},
+	}
+	for name, r := range DefaultRlimits {
+		config.Rlimits[name] = r
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "rlimits.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	rlimits := map[string]RlimitRange{}
+	if err := json.Unmarshal(data, &rlimits); err != nil {
+		return Config{}, fmt.Errorf("invalid rlimits config: %v", err)
+	}
+	for name, r := range rlimits {
+		if _, ok := DefaultRlimits[name]; !ok {
+			return Config{}, fmt.Errorf("invalid rlimits config: unknown resource %q", name)
+		}
+		if r.Default > r.Max {
+			return Config{}, fmt.Errorf("invalid rlimits config: %s default exceeds max", name)
+		}
+		config.Rlimits[name] = r
+	}
+	return config, nil
+}
@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+)
+
+// minCPUQuota is the smallest CFS quota accepted by the kernel, in microseconds
+const minCPUQuota = 1000
+
+// cpuAllocator assigns non-overlapping sets of CPUs from the exclusive pool.
+type cpuAllocator struct {
+	mutex sync.Mutex
+	pool  []int
+	used  map[int]bool
+}
+
+func newCPUAllocator(pool []int) *cpuAllocator {
+	return &cpuAllocator{pool: pool, used: map[int]bool{}}
+}
+
+// Allocate assigns n free CPUs of the pool, lowest first.
+func (a *cpuAllocator) Allocate(n int) ([]int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cpus := []int{}
+	for _, cpu := range a.pool {
+		if len(cpus) == n {
+			break
+		}
+		if !a.used[cpu] {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) < n {
+		return nil, fmt.Errorf("%w: %d exclusive CPUs requested, %d available", ErrLimitExceeded, n, len(cpus))
+	}
+	for _, cpu := range cpus {
+		a.used[cpu] = true
+	}
+	return cpus, nil
+}
+
+// Release returns the CPUs to the pool.
+func (a *cpuAllocator) Release(cpus []int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, cpu := range cpus {
+		delete(a.used, cpu)
+	}
+}
+
+// ParseExclusiveCPUs parses the list of CPUs reserved for the jobs requesting
+// exclusive CPUs. At least one online CPU must be left to the other jobs.
+func ParseExclusiveCPUs(list string) ([]int, error) {
+	cpus, err := cgroup.ParseList(list)
+	if err != nil || len(cpus) == 0 {
+		return cpus, err
+	}
+	online, err := cgroup.OnlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	if !containsAll(online, cpus) {
+		return nil, fmt.Errorf("exclusive CPUs %q are not online", list)
+	}
+	if len(cpus) == len(online) {
+		return nil, fmt.Errorf("exclusive CPUs %q leave no CPU to the other jobs", list)
+	}
+	return cpus, nil
+}
+
+// assignCPUs validates the CPU quota and pinning of the job and assigns it
+// exclusive CPUs if requested. Jobs without exclusive CPUs never run
+// on the exclusive pool, so the CPUs assigned to a job are its own.
+func (m *ProcManager) assignCPUs(opts *JobOptions) error {
+	online, err := cgroup.OnlineCPUs()
+	if err != nil {
+		return err
+	}
+	if opts.cpuQuota, err = cpuQuota(opts.CPUs, len(online)); err != nil {
+		return err
+	}
+
+	if len(opts.MemSet) != 0 {
+		mems, err := cgroup.ParseList(opts.MemSet)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		onlineMems, err := cgroup.OnlineMems()
+		if err != nil {
+			return err
+		}
+		if !containsAll(onlineMems, mems) || len(mems) == 0 {
+			return fmt.Errorf("%w: memory nodes %q", ErrInvalidArgument, opts.MemSet)
+		}
+		opts.mems = cgroup.FormatList(mems)
+	}
+
+	if opts.ExclusiveCPUs != 0 {
+		if len(opts.CPUSet) != 0 {
+			return fmt.Errorf("%w: exclusive CPUs and a CPU set are mutually exclusive", ErrInvalidArgument)
+		}
+		if opts.ExclusiveCPUs < 0 || len(m.cpus.pool) == 0 {
+			return fmt.Errorf("%w: no exclusive CPUs", ErrLimitExceeded)
+		}
+		if opts.exclusive, err = m.cpus.Allocate(opts.ExclusiveCPUs); err != nil {
+			return err
+		}
+		opts.cpus = cgroup.FormatList(opts.exclusive)
+		return nil
+	}
+
+	if len(opts.CPUSet) != 0 {
+		cpus, err := cgroup.ParseList(opts.CPUSet)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		if !containsAll(online, cpus) || len(cpus) == 0 {
+			return fmt.Errorf("%w: CPU set %q", ErrInvalidArgument, opts.CPUSet)
+		}
+		for _, cpu := range cpus {
+			if containsInt(m.cpus.pool, cpu) {
+				return fmt.Errorf("%w: CPU %d is reserved for exclusive jobs", ErrPermDenied, cpu)
+			}
+		}
+		opts.cpus = cgroup.FormatList(cpus)
+		return nil
+	}
+
+	// keep the shared jobs off the exclusive pool
+	if len(m.cpus.pool) != 0 {
+		shared := []int{}
+		for _, cpu := range online {
+			if !containsInt(m.cpus.pool, cpu) {
+				shared = append(shared, cpu)
+			}
+		}
+		opts.cpus = cgroup.FormatList(shared)
+	}
+	return nil
+}
+
+// cpuQuota converts a CPU quota in CPUs to the CPU time per DefaultCPUPeriod,
+// zero for no quota.
+func cpuQuota(cpus float64, online int) (int64, error) {
+	if cpus < 0 || cpus > float64(online) {
+		return 0, fmt.Errorf("%w: CPU quota %g exceeds %d CPUs", ErrLimitExceeded, cpus, online)
+	}
+	if cpus == 0 {
+		return 0, nil
+	}
+	quota := int64(cpus * cgroup.DefaultCPUPeriod)
+	if quota < minCPUQuota {
+		return 0, fmt.Errorf("%w: CPU quota %g is too small", ErrInvalidArgument, cpus)
+	}
+	return quota, nil
+}
+
+func containsAll(list, items []int) bool {
+	for _, item := range items {
+		if !containsInt(list, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
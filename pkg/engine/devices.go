@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+)
+
+// Device is a host device node a job may access besides cgroup.DefaultDevices.
+type Device struct {
+	Path string
+	// Access is a combination of "r" (read), "w" (write) and "m" (mknod), "rw" if empty
+	Access string
+}
+
+// checkDevices verifies the job devices against the policy and resolves
+// their paths, so a symbolic link cannot lead to a device the client may not use.
+func (p *Policy) checkDevices(devices []Device) error {
+	for i := range devices {
+		dev := &devices[i]
+		if !filepath.IsAbs(dev.Path) {
+			return fmt.Errorf("%w: device %q is not an absolute path", ErrInvalidArgument, dev.Path)
+		}
+		path, err := filepath.EvalSymlinks(dev.Path)
+		if err != nil {
+			return fmt.Errorf("%w: device: %v", ErrInvalidArgument, err)
+		}
+		// the runner takes the devices as path:access
+		if strings.Contains(path, ":") {
+			return fmt.Errorf("%w: device %q contains ':'", ErrInvalidArgument, path)
+		}
+		if !p.allowsDevice(path) {
+			return fmt.Errorf("%w: device %s", ErrPermDenied, dev.Path)
+		}
+		if len(dev.Access) == 0 {
+			dev.Access = "rw"
+		}
+		if _, err := cgroup.DeviceOf(path, dev.Access); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		dev.Path = path
+	}
+	return nil
+}
+
+// allowsDevice reports whether the path matches a device pattern of the policy.
+func (p *Policy) allowsDevice(path string) bool {
+	for _, pattern := range p.Devices {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
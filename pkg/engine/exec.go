@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+	"github.com/dmitsh/gravitest/proto"
+)
+
+// ExecProcess is a command run inside a running job by ExecInProcess.
+type ExecProcess struct {
+	cmd    *exec.Cmd
+	output *BufWriter
+	done   chan struct{}
+
+	statusMutex sync.Mutex
+	status      proto.Status
+}
+
+// Output returns the combined standard and error output of the command,
+// which ends when the command terminates.
+func (e *ExecProcess) Output() io.ReadCloser {
+	return NewBufReader(e.output)
+}
+
+// Wait waits for the command to terminate and returns its status.
+func (e *ExecProcess) Wait() *proto.Status {
+	<-e.done
+	e.statusMutex.Lock()
+	defer e.statusMutex.Unlock()
+	return &proto.Status{
+		ProcStatus: e.status.ProcStatus,
+		ExitStatus: e.status.ExitStatus,
+		Signal:     e.status.Signal,
+		Seccomp:    e.status.Seccomp,
+	}
+}
+
+// Kill kills the command, e.g. once its client is gone.
+func (e *ExecProcess) Kill() {
+	syscall.Kill(-e.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// ExecInProcess runs a command in the namespaces and the cgroup of a running job,
+// with the credential, capabilities, rlimits and seccomp filter of the job.
+// With tty set the command runs on a pseudo-terminal.
+func (m *ProcManager) ExecInProcess(id Identity, uid string, tty bool, exe string, args ...string) (*ExecProcess, error) {
+	m.procMutex.Lock()
+	proc, err := m.ownProcess(id, uid)
+	if err != nil {
+		m.procMutex.Unlock()
+		return nil, err
+	}
+	if proc.status.ProcStatus != proto.Status_StatusRunning {
+		m.procMutex.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrInvalidState, proc.status.ProcStatus)
+	}
+	runnerPID := proc.cmd.Process.Pid
+	hostRoot := len(proc.opts.Rootfs) == 0
+	// UpdateResources changes the job options under the lock
+	runnerArgs := append([]string{"enter"}, proc.opts.runnerArgs()...)
+	m.procMutex.Unlock()
+
+	exe, err = m.grant(id).checkExecutable(exe, args, hostRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroupName := "worker-" + uid
+	initPID, err := jobInitPID(cgroupName, runnerPID)
+	if err != nil {
+		return nil, err
+	}
+
+	runnerArgs = append(runnerArgs, "-target", strconv.Itoa(initPID))
+	if tty {
+		runnerArgs = append(runnerArgs, "-tty")
+	}
+	runnerArgs = append(runnerArgs, cgroupName, exe)
+
+	e := &ExecProcess{
+		cmd:    exec.Command("./runner", append(runnerArgs, args...)...),
+		output: NewBufWriter(),
+		done:   make(chan struct{}),
+	}
+	e.cmd.Stdout = e.output
+	e.cmd.Stderr = e.output
+	e.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	reportR, reportW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	e.cmd.ExtraFiles = []*os.File{reportW}
+	err = e.cmd.Start()
+	reportW.Close()
+	if err != nil {
+		reportR.Close()
+		return nil, err
+	}
+	e.status.ProcStatus = proto.Status_StatusRunning
+
+	go func() {
+		defer close(e.done)
+		defer reportR.Close()
+
+		err := e.cmd.Wait()
+		report, reportErr := readReport(reportR)
+		e.output.Close()
+
+		e.statusMutex.Lock()
+		defer e.statusMutex.Unlock()
+		e.status.ProcStatus = proto.Status_StatusStopped
+		if reportErr == nil {
+			e.status.ExitStatus = int32(report.ExitStatus)
+			e.status.Signal = int32(report.Signal)
+			e.status.Seccomp = report.Seccomp
+		} else if err != nil {
+			e.status.ExitStatus = int32(e.cmd.ProcessState.ExitCode())
+			if status, ok := e.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				e.status.Signal = int32(status.Signal())
+			}
+			log.Printf("failed to exec %q in %s : %v", strings.Join(append([]string{exe}, args...), " "), uid, err)
+		}
+	}()
+
+	return e, nil
+}
+
+// jobInitPID returns the PID of the job init: the process of the job cgroup
+// whose parent is the runner, as the commands entering the job join the cgroup too.
+func jobInitPID(cgroupName string, runnerPID int) (int, error) {
+	pids, err := cgroup.New(cgroupName).Processes()
+	if err != nil {
+		return 0, fmt.Errorf("%w: job cgroup: %v", ErrInvalidState, err)
+	}
+	for _, pid := range pids {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// the command name in parentheses may contain spaces, the fields follow it
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) >= 2 && fields[1] == strconv.Itoa(runnerPID) {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: job init process not found", ErrInvalidState)
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExecRule allows starting the executables matching Path with the arguments matching Args.
+type ExecRule struct {
+	// Path is the absolute path or a filepath.Match pattern of the executables, e.g. /usr/bin/*
+	Path string `yaml:"path"`
+	// Args are regular expressions every argument must fully match one of,
+	// any arguments are allowed if not set, none if empty
+	Args []string `yaml:"args"`
+
+	// compiled Args
+	args []*regexp.Regexp
+}
+
+// compile validates the rule and compiles its argument expressions.
+func (r *ExecRule) compile() error {
+	if _, err := filepath.Match(r.Path, ""); err != nil || !filepath.IsAbs(r.Path) {
+		return fmt.Errorf("invalid executable pattern %q", r.Path)
+	}
+	r.args = nil
+	for _, expr := range r.Args {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid argument expression %q of %s: %v", expr, r.Path, err)
+		}
+		r.args = append(r.args, re)
+	}
+	return nil
+}
+
+// allows reports whether the rule allows the executable path with the arguments,
+// and otherwise returns the first argument it rejects, if any.
+func (r *ExecRule) allows(path string, args []string) (bool, string) {
+	if ok, _ := filepath.Match(r.Path, path); !ok {
+		return false, ""
+	}
+	if r.Args == nil {
+		return true, ""
+	}
+	for _, arg := range args {
+		matched := false
+		for _, re := range r.args {
+			if re.MatchString(arg) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, arg
+		}
+	}
+	return true, ""
+}
+
+// Role grants permissions and may restrict the executables of the jobs; a role granting
+// start or exec without executables lifts the restrictions of the other roles and policies.
+// The policy file defines a role by its permission names, or by permissions and executables:
+//
+//	roles:
+//	  deployer: [start, stop, status]
+//	  builder:
+//	    permissions: [start, stop, status, stream]
+//	    executables:
+//	      - {path: /usr/bin/make, args: ['-j[0-9]+', '[a-z]+']}
+type Role struct {
+	Permissions []string    `yaml:"permissions"`
+	Executables []*ExecRule `yaml:"executables"`
+
+	// permission bitmap of Permissions
+	perm int
+}
+
+// UnmarshalYAML decodes the short form, a list of permission names, or the full form.
+func (r *Role) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&r.Permissions)
+	}
+	type role Role
+	return node.Decode((*role)(r))
+}
+
+// checkExecutable verifies the job executable and arguments against the executable rules
+// of the grant, if any, one of which must allow them, and returns the executable path to run.
+// On the host root filesystem the executable is resolved like the shell does, so the job
+// runs the executable checked whatever its PATH is; in a job root filesystem it must be
+// an absolute path.
+func (g grant) checkExecutable(exe string, args []string, hostRoot bool) (string, error) {
+	if len(g.executables) == 0 {
+		return exe, nil
+	}
+	path := exe
+	if hostRoot {
+		var err error
+		if path, err = exec.LookPath(exe); err != nil {
+			return "", fmt.Errorf("%w: executable %s: %v", ErrPermDenied, exe, err)
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	} else if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%w: executable %s is not an absolute path, as required by the executable rules", ErrPermDenied, exe)
+	}
+	path = filepath.Clean(path)
+
+	rejected := []string{}
+	for _, rule := range g.executables {
+		ok, arg := rule.allows(path, args)
+		if ok {
+			return path, nil
+		}
+		if len(arg) != 0 {
+			rejected = append(rejected, fmt.Sprintf("%q", arg))
+		}
+	}
+	if len(rejected) != 0 {
+		return "", fmt.Errorf("%w: arguments of %s are not allowed by the executable rules: %s", ErrPermDenied, path, strings.Join(rejected, ", "))
+	}
+	return "", fmt.Errorf("%w: executable %s is not allowed by the executable rules", ErrPermDenied, path)
+}
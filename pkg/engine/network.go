@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// job network modes
+const (
+	// NetworkNone isolates the job in its own network namespace with loopback only
+	NetworkNone = "none"
+	// NetworkHost shares the host network namespace
+	NetworkHost = "host"
+	// NetworkBridged connects the job to the server managed bridge with NAT
+	NetworkBridged = "bridged"
+)
+
+const (
+	bridgeName = "gravitest0"
+	bridgeAddr = "10.88.0.1/16"
+
+	// iptables chains filtering the traffic of the jobs to the host and through it
+	inputChain   = "GRAVITEST-INPUT"
+	forwardChain = "GRAVITEST-FORWARD"
+)
+
+// inputRules let the jobs ping the gateway, but keep them away from the host services,
+// such as the server API, on any host address
+var inputRules = [][]string{
+	{"-p", "icmp", "--icmp-type", "echo-request", "-j", "ACCEPT"},
+	{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	{"-j", "DROP"},
+}
+
+// forwardRules let the jobs connect out of the bridge, and only get the replies back.
+// The bridge ports are isolated, the first rule covers the hosts filtering the bridged traffic.
+var forwardRules = [][]string{
+	{"-i", bridgeName, "-o", bridgeName, "-j", "DROP"},
+	{"-i", bridgeName, "-j", "ACCEPT"},
+	{"-o", bridgeName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	{"-o", bridgeName, "-j", "DROP"},
+}
+
+var ErrNoAddress = errors.New("no free network address")
+
+// Bridge manages the host bridge used by the jobs in the bridged network mode
+// and allocates the job addresses from its subnet.
+type Bridge struct {
+	mutex   sync.Mutex
+	ready   bool
+	gateway net.IP
+	subnet  *net.IPNet
+	// allocated addresses [IP : in use]
+	used map[string]bool
+}
+
+func NewBridge() *Bridge {
+	gateway, subnet, _ := net.ParseCIDR(bridgeAddr)
+	return &Bridge{
+		gateway: gateway,
+		subnet:  subnet,
+		used:    map[string]bool{gateway.String(): true},
+	}
+}
+
+// Allocate sets up the bridge on first use and returns a free job address
+// in CIDR notation along with the gateway address.
+func (b *Bridge) Allocate() (string, string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.ready {
+		if err := b.setup(); err != nil {
+			return "", "", err
+		}
+		b.ready = true
+	}
+
+	ones, _ := b.subnet.Mask.Size()
+	for ip := nextIP(b.subnet.IP); b.subnet.Contains(ip); ip = nextIP(ip) {
+		if b.used[ip.String()] || isBroadcast(ip, b.subnet) {
+			continue
+		}
+		b.used[ip.String()] = true
+		return fmt.Sprintf("%s/%d", ip, ones), b.gateway.String(), nil
+	}
+	return "", "", ErrNoAddress
+}
+
+// Release returns the job address to the pool.
+func (b *Bridge) Release(addr string) {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.used, ip.String())
+}
+
+// setup creates the bridge, isolates the jobs, enables forwarding and masquerades the job traffic.
+// The forwarding is enabled for all the host interfaces.
+func (b *Bridge) setup() error {
+	if _, err := net.InterfaceByName(bridgeName); err != nil {
+		if err := run("ip", "link", "add", "name", bridgeName, "type", "bridge"); err != nil {
+			return err
+		}
+		if err := run("ip", "addr", "add", bridgeAddr, "dev", bridgeName); err != nil {
+			return err
+		}
+	}
+	if err := run("ip", "link", "set", bridgeName, "up"); err != nil {
+		return err
+	}
+	if err := setChain(inputChain, inputRules); err != nil {
+		return err
+	}
+	if err := setChain(forwardChain, forwardRules); err != nil {
+		return err
+	}
+	for _, rule := range [][]string{
+		{"INPUT", "-i", bridgeName, "-j", inputChain},
+		{"FORWARD", "-i", bridgeName, "-j", forwardChain},
+		{"FORWARD", "-o", bridgeName, "-j", forwardChain},
+	} {
+		if err := ensureRule("filter", "-I", rule); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return err
+	}
+	return ensureRule("nat", "-A", []string{"POSTROUTING", "-s", b.subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE"})
+}
+
+// setChain creates the filter chain if needed and replaces its rules.
+func setChain(chain string, rules [][]string) error {
+	if err := run("iptables", "-n", "-L", chain); err != nil {
+		if err := run("iptables", "-N", chain); err != nil {
+			return err
+		}
+	}
+	if err := run("iptables", "-F", chain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := run("iptables", append([]string{"-A", chain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRule adds the rule to the table with the command, -A or -I, unless it exists.
+func ensureRule(table, command string, rule []string) error {
+	if err := run("iptables", append([]string{"-t", table, "-C"}, rule...)...); err == nil {
+		return nil
+	}
+	return run("iptables", append([]string{"-t", table, command}, rule...)...)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func isBroadcast(ip net.IP, subnet *net.IPNet) bool {
+	ip4 := ip.To4()
+	for i := range ip4 {
+		if ip4[i]|subnet.Mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dmitsh/gravitest/pkg/capability"
+)
+
+// User is the credential the user command runs with.
+type User struct {
+	UID    uint32   `yaml:"uid"`
+	GID    uint32   `yaml:"gid"`
+	Groups []uint32 `yaml:"groups"`
+}
+
+// JobOptions holds the isolation settings requested for a job.
+type JobOptions struct {
+	// HostProc keeps the host /proc view inside the job
+	HostProc bool
+	// Hostname is the job hostname, the first group of the job UUID by default
+	Hostname string
+	// Network is the job network mode, NetworkNone by default
+	Network string
+	// User is the job credential, the client policy default if not set
+	User *User
+	// UserNamespace runs the job in a new user namespace mapped to the client's host ID range
+	UserNamespace bool
+	// Rootfs is the name of the job root filesystem image in Config.ImageDir, see image.Store.Layers;
+	// the host root if empty
+	Rootfs string
+	// Mounts are mounted in order on top of the job root filesystem
+	Mounts []Mount
+	// Devices are the host devices the job may access besides cgroup.DefaultDevices
+	Devices []Device
+	// Seccomp is the seccomp profile name, SeccompDefault if empty
+	Seccomp string
+	// Capabilities are granted to the job in addition to capability.Default.
+	// Unlike the default ones, they are kept by jobs not running as root.
+	Capabilities []string
+	// Rlimits maps the rlimit names, see DefaultRlimits, to the values applied
+	// as both the soft and the hard limit; the server defaults apply to the others
+	Rlimits map[string]uint64
+	// Memory limits the job memory usage in bytes, DefaultMemory if zero
+	Memory uint64
+	// CPUShares is the relative CPU weight of the job, DefaultCPUShares if zero
+	CPUShares uint64
+	// CPUs is the hard CPU quota of the job in CPUs, e.g. 0.5; the client ceiling if zero
+	CPUs float64
+	// CPUSet and MemSet pin the job to the CPUs and memory nodes in the "0-3,5" list format
+	CPUSet string
+	MemSet string
+	// ExclusiveCPUs is the number of CPUs the server assigns to the job alone
+	ExclusiveCPUs int
+
+	// bridged network settings assigned by the engine
+	addr    string
+	gateway string
+	// user namespace host ID range assigned by the engine
+	idMapBase uint32
+	// rootfs image layers and job directory prepared by the engine
+	layers []string
+	jobDir string
+	// seccomp profile resolved by the engine
+	seccomp string
+	// additional capabilities allowed by the client policy
+	caps []capability.Cap
+	// all the job rlimits, including the server defaults
+	rlimits map[string]uint64
+	// CPU quota and pinning resolved by the engine, and the exclusive CPUs assigned to the job
+	cpuQuota  int64
+	cpus      string
+	mems      string
+	exclusive []int
+}
+
+// runnerArgs converts the job options to the runner command line flags.
+func (o *JobOptions) runnerArgs() []string {
+	args := []string{"-net", o.Network, "-hostname", o.Hostname}
+	if o.HostProc {
+		args = append(args, "-host-proc")
+	}
+	if o.Network == NetworkBridged {
+		args = append(args, "-bridge", bridgeName, "-addr", o.addr, "-gateway", o.gateway)
+	}
+	if o.User != nil {
+		args = append(args, "-uid", formatID(o.User.UID), "-gid", formatID(o.User.GID))
+		if len(o.User.Groups) != 0 {
+			groups := make([]string, 0, len(o.User.Groups))
+			for _, gid := range o.User.Groups {
+				groups = append(groups, formatID(gid))
+			}
+			args = append(args, "-groups", strings.Join(groups, ","))
+		}
+	}
+	if o.UserNamespace {
+		args = append(args, "-userns-base", formatID(o.idMapBase), "-userns-size", strconv.Itoa(IDMapSize))
+	}
+	if len(o.Rootfs) != 0 {
+		args = append(args,
+			"-rootfs", filepath.Join(o.jobDir, "rootfs"),
+			"-lower", strings.Join(o.layers, ":"),
+			"-upper", filepath.Join(o.jobDir, "upper"),
+			"-work", filepath.Join(o.jobDir, "work"))
+	}
+	for _, mount := range o.Mounts {
+		switch mount.Type {
+		case MountBind:
+			spec := mount.Source + ":" + mount.Target
+			if mount.ReadOnly {
+				spec += ":ro"
+			}
+			args = append(args, "-bind", spec)
+		case MountTmpfs:
+			args = append(args, "-tmpfs", mount.Target+":"+strconv.FormatUint(mount.Size, 10))
+		}
+	}
+	for _, dev := range o.Devices {
+		args = append(args, "-device", dev.Path+":"+dev.Access)
+	}
+	if len(o.seccomp) != 0 {
+		args = append(args, "-seccomp", o.seccomp)
+	}
+	args = append(args, "-caps", capability.Join(append(append([]capability.Cap(nil), capability.Default...), o.caps...)))
+	if len(o.caps) != 0 {
+		args = append(args, "-ambient", capability.Join(o.caps))
+	}
+	args = append(args, "-memory", strconv.FormatUint(o.Memory, 10), "-cpu-shares", strconv.FormatUint(o.CPUShares, 10))
+	if o.cpuQuota != 0 {
+		args = append(args, "-cpu-quota", strconv.FormatInt(o.cpuQuota, 10))
+	}
+	if len(o.cpus) != 0 {
+		args = append(args, "-cpus", o.cpus)
+	}
+	if len(o.mems) != 0 {
+		args = append(args, "-mems", o.mems)
+	}
+	names := make([]string, 0, len(o.rlimits))
+	for name := range o.rlimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-rlimit", name+"="+formatRlimit(o.rlimits[name]))
+	}
+	return args
+}
+
+func formatID(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// mount types
+const (
+	// MountBind bind mounts a host path into the job
+	MountBind = "bind"
+	// MountTmpfs mounts a size limited tmpfs destroyed with the job
+	MountTmpfs = "tmpfs"
+)
+
+// Mount is a host path or a scratch filesystem mounted into the job.
+type Mount struct {
+	Type   string
+	Source string // host path of a bind mount
+	Target string // absolute path inside the job
+	// ReadOnly mounts a bind mount read-only
+	ReadOnly bool
+	// Size is the tmpfs size limit in bytes
+	Size uint64
+}
+
+// validHostname checks the hostname is a sequence of dot separated labels
+// of letters, digits and hyphens, as accepted by sethostname(2) and resolvers.
+func validHostname(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dmitsh/gravitest/pkg/capability"
+)
+
+// IDMapSize is the number of user and group IDs mapped into a job user namespace.
+const IDMapSize = 65536
+
+// NobodyID is the user and group ID of the jobs of the policies without a default user.
+const NobodyID = 65534
+
+// Policy holds the API permissions of a client and the job settings it is allowed to request.
+type Policy struct {
+	// Permissions lists the names of the APIs the client may call, see PermNames
+	Permissions []string `yaml:"permissions"`
+	// Roles grants the client the permissions of the roles, see DefaultRoles
+	Roles []string `yaml:"roles"`
+	// HostNetwork allows jobs to share the host network namespace
+	HostNetwork bool `yaml:"hostNetwork"`
+	// HostProc allows jobs to keep the host /proc view instead of a private one
+	HostProc bool `yaml:"hostProc"`
+	// User is the default user the client's jobs run as, NobodyID if not set
+	User *User `yaml:"user"`
+	// UIDs and GIDs list the additional IDs the client may run jobs as;
+	// the jobs run as root only if the policy lists ID 0 explicitly
+	UIDs []uint32 `yaml:"uids"`
+	GIDs []uint32 `yaml:"gids"`
+	// IDMapBase is the first host ID the job IDs are mapped to in the user namespace mode.
+	// Zero disables the mode for the client.
+	IDMapBase uint32 `yaml:"idMapBase"`
+	// Mounts lists the host paths the client may bind mount into its jobs
+	Mounts []MountRule `yaml:"mounts"`
+	// TmpfsSize caps the total size of the tmpfs mounts of a job, zero disables them
+	TmpfsSize uint64 `yaml:"tmpfsSize"`
+	// Devices lists the host device paths or filepath.Match patterns of the devices
+	// the client's jobs may access besides cgroup.DefaultDevices
+	Devices []string `yaml:"devices"`
+	// SeccompProfiles lists the seccomp profiles the client may request besides
+	// SeccompDefault, including SeccompUnconfined to run jobs without a filter
+	SeccompProfiles []string `yaml:"seccompProfiles"`
+	// Capabilities lists the capabilities the client may add to capability.Default
+	Capabilities []string `yaml:"capabilities"`
+	// MaxMemory, MaxCPUShares and MaxCPUs are the ceilings of the job resources,
+	// both at the start and when updated, zero for no ceiling.
+	// The jobs not requesting a CPU quota get MaxCPUs.
+	MaxMemory    uint64  `yaml:"maxMemory"`
+	MaxCPUShares uint64  `yaml:"maxCpuShares"`
+	MaxCPUs      float64 `yaml:"maxCpus"`
+	// Executables restricts the executables of the client's jobs, see ExecRule.
+	// The rules of the client, its groups and its roles combine.
+	Executables []*ExecRule `yaml:"executables"`
+
+	// permission bitmap of Permissions
+	perm int
+}
+
+// MountRule allows bind mounting a host path and everything below it.
+type MountRule struct {
+	Path string `yaml:"path"`
+	// ReadWrite allows read-write bind mounts, otherwise they must be read-only
+	ReadWrite bool `yaml:"readWrite"`
+}
+
+// applyPolicy verifies the requested job options against the client policy
+// and fills in the policy defaults.
+func (m *ProcManager) applyPolicy(id Identity, opts *JobOptions) error {
+	policy := m.grant(id).policy
+	if policy == nil {
+		return fmt.Errorf("%w: no job policy", ErrPermDenied)
+	}
+	if opts.Network == NetworkHost && !policy.HostNetwork {
+		return fmt.Errorf("%w: host network", ErrPermDenied)
+	}
+	if opts.HostProc && !policy.HostProc {
+		return fmt.Errorf("%w: host /proc", ErrPermDenied)
+	}
+
+	if err := policy.checkMounts(opts.Mounts); err != nil {
+		return err
+	}
+	if err := policy.checkDevices(opts.Devices); err != nil {
+		return err
+	}
+
+	if len(opts.Seccomp) == 0 {
+		opts.Seccomp = SeccompDefault
+	}
+	if opts.Seccomp != SeccompDefault && !containsString(policy.SeccompProfiles, opts.Seccomp) {
+		return fmt.Errorf("%w: seccomp profile %q", ErrPermDenied, opts.Seccomp)
+	}
+
+	if err := policy.checkCapabilities(opts); err != nil {
+		return err
+	}
+
+	if opts.Memory == 0 {
+		opts.Memory = DefaultMemory
+	}
+	if opts.CPUShares == 0 {
+		opts.CPUShares = DefaultCPUShares
+	}
+	if opts.CPUs == 0 {
+		opts.CPUs = policy.MaxCPUs
+	}
+	if err := policy.checkResources(Resources{Memory: opts.Memory, CPUShares: opts.CPUShares, CPUs: opts.CPUs}); err != nil {
+		return err
+	}
+
+	defaultUser := User{UID: NobodyID, GID: NobodyID}
+	if policy.User != nil {
+		defaultUser = *policy.User
+	}
+	if opts.User == nil {
+		user := defaultUser
+		opts.User = &user
+	}
+	if opts.UserNamespace {
+		if policy.IDMapBase == 0 {
+			return fmt.Errorf("%w: user namespace", ErrPermDenied)
+		}
+		// any ID inside the namespace maps to the client's unprivileged host range
+		for _, id := range append([]uint32{opts.User.UID, opts.User.GID}, opts.User.Groups...) {
+			if id >= IDMapSize {
+				return fmt.Errorf("%w: id %d is outside of the user namespace", ErrPermDenied, id)
+			}
+		}
+		opts.idMapBase = policy.IDMapBase
+		return nil
+	}
+	if !containsID(append([]uint32{defaultUser.UID}, policy.UIDs...), opts.User.UID) {
+		return fmt.Errorf("%w: uid %d", ErrPermDenied, opts.User.UID)
+	}
+	gids := append(append([]uint32{defaultUser.GID}, defaultUser.Groups...), policy.GIDs...)
+	for _, gid := range append([]uint32{opts.User.GID}, opts.User.Groups...) {
+		if !containsID(gids, gid) {
+			return fmt.Errorf("%w: gid %d", ErrPermDenied, gid)
+		}
+	}
+	return nil
+}
+
+// checkMounts verifies the job mounts against the policy and resolves
+// the bind mount sources, so a symbolic link cannot lead outside of an allowed path.
+func (p *Policy) checkMounts(mounts []Mount) error {
+	var tmpfsSize uint64
+	for i := range mounts {
+		mount := &mounts[i]
+		if !filepath.IsAbs(mount.Target) {
+			return fmt.Errorf("%w: mount target %q is not an absolute path", ErrInvalidArgument, mount.Target)
+		}
+		mount.Target = filepath.Clean(mount.Target)
+		// the runner takes the mounts as source:target[:ro] and target:size
+		if strings.Contains(mount.Target, ":") {
+			return fmt.Errorf("%w: mount target %q contains ':'", ErrInvalidArgument, mount.Target)
+		}
+
+		switch mount.Type {
+		case MountBind:
+			if !filepath.IsAbs(mount.Source) {
+				return fmt.Errorf("%w: mount source %q is not an absolute path", ErrInvalidArgument, mount.Source)
+			}
+			source, err := filepath.EvalSymlinks(mount.Source)
+			if err != nil {
+				return fmt.Errorf("%w: mount source: %v", ErrInvalidArgument, err)
+			}
+			if strings.Contains(source, ":") {
+				return fmt.Errorf("%w: mount source %q contains ':'", ErrInvalidArgument, source)
+			}
+			rule := p.mountRule(source)
+			if rule == nil {
+				return fmt.Errorf("%w: mount %s", ErrPermDenied, mount.Source)
+			}
+			if !mount.ReadOnly && !rule.ReadWrite {
+				return fmt.Errorf("%w: read-write mount %s", ErrPermDenied, mount.Source)
+			}
+			mount.Source = source
+		case MountTmpfs:
+			if mount.Size == 0 {
+				return fmt.Errorf("%w: tmpfs %s requires a size limit", ErrInvalidArgument, mount.Target)
+			}
+			if tmpfsSize += mount.Size; tmpfsSize > p.TmpfsSize {
+				return fmt.Errorf("%w: tmpfs size exceeds %d bytes", ErrPermDenied, p.TmpfsSize)
+			}
+		default:
+			return fmt.Errorf("%w: mount type %q", ErrInvalidArgument, mount.Type)
+		}
+	}
+	return nil
+}
+
+// mountRule returns the rule allowing to mount the path, if any.
+func (p *Policy) mountRule(path string) *MountRule {
+	for i, rule := range p.Mounts {
+		if path == rule.Path || strings.HasPrefix(path, strings.TrimSuffix(rule.Path, "/")+"/") {
+			return &p.Mounts[i]
+		}
+	}
+	return nil
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCapabilities verifies the requested capabilities are allowed
+// and resolves them for the runner.
+func (p *Policy) checkCapabilities(opts *JobOptions) error {
+	opts.caps = nil
+	for _, name := range opts.Capabilities {
+		c, err := capability.Parse(name)
+		if err != nil {
+			return err
+		}
+		allowed := false
+		for _, allowedName := range p.Capabilities {
+			if a, err := capability.Parse(allowedName); err == nil && a == c {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: capability %s", ErrPermDenied, c)
+		}
+		opts.caps = append(opts.caps, c)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
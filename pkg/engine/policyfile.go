@@ -0,0 +1,389 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dmitsh/gravitest/pkg/capability"
+)
+
+// PermNames maps the permission names of the policy file to the permission bits.
+var PermNames = map[string]int{
+	"start":  PermStart,
+	"stop":   PermStop,
+	"status": PermStatus,
+	"stream": PermStream,
+	"pause":  PermPause,
+	"resume": PermResume,
+	"exec":   PermExec,
+	"update": PermUpdate,
+	"share":  PermShare,
+
+	"crossTenant": PermCrossTenant,
+}
+
+// built-in roles
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// DefaultRoles maps the built-in roles to their permission names.
+// The policy file may redefine them.
+var DefaultRoles = map[string][]string{
+	RoleViewer:   {"status", "stream"},
+	RoleOperator: {"status", "stream", "start", "stop", "pause", "resume", "exec", "update", "share"},
+	RoleAdmin:    {"status", "stream", "start", "stop", "pause", "resume", "exec", "update", "share", "crossTenant"},
+}
+
+// Identity is the authenticated identity of a client.
+type Identity struct {
+	// ID is the client ID owning the client's jobs, e.g. the certificate CN or SPIFFE ID
+	ID string
+	// Groups are the organizations (O) and organizational units (OU) of the certificate
+	Groups []string
+	// SANs are the subject alternative names of the certificate:
+	// DNS names, email addresses, IP addresses and URIs
+	SANs []string
+	// Decision, if set, receives the authorization decision of the call
+	Decision *Decision
+}
+
+// Policies is the authorization table of the server, in YAML or JSON:
+//
+//	roles:
+//	  deployer: [start, stop, status]
+//	  builder:
+//	    permissions: [start, stop, status, stream]
+//	    executables:
+//	      - {path: /usr/bin/make}
+//	groups:
+//	  - name: ci
+//	    roles: [operator]
+//	    certGroups: [build]
+//	    policy:
+//	      user: {uid: 65534, gid: 65534}
+//	clients:
+//	  client1:
+//	    roles: [admin]
+//	    uids: [65534]
+//	    mounts:
+//	      - {path: /tmp, readWrite: true}
+type Policies struct {
+	// Roles defines roles in addition to DefaultRoles, see Role
+	Roles map[string]*Role `yaml:"roles"`
+	// Groups grant roles and job policies to the clients matching them
+	Groups []*Group `yaml:"groups"`
+	// Clients maps client IDs to their own permissions and job policy
+	Clients map[string]*Policy `yaml:"clients"`
+
+	// the default and the defined roles
+	roles map[string]*Role
+}
+
+// Group grants its roles to its members, i.e. the listed clients
+// and the clients with any of the listed certificate groups or SANs.
+type Group struct {
+	Name  string   `yaml:"name"`
+	Roles []string `yaml:"roles"`
+	// Members lists the client IDs of the group
+	Members []string `yaml:"members"`
+	// CertGroups lists the certificate organizations and organizational units of the group
+	CertGroups []string `yaml:"certGroups"`
+	// SANs lists the certificate subject alternative names of the group
+	SANs []string `yaml:"sans"`
+	// Policy is the job policy of the members without a client policy,
+	// the one of the first group listing it applies
+	Policy *Policy `yaml:"policy"`
+
+	// permission bitmap of Roles
+	perm int
+}
+
+// LoadPolicies reads and validates the policy table from a YAML or JSON file.
+func LoadPolicies(path string) (*Policies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := ParsePolicies(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return policies, nil
+}
+
+// ParsePolicies decodes and validates a YAML or JSON policy table.
+func ParsePolicies(data []byte) (*Policies, error) {
+	p := &Policies{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+
+	p.roles = map[string]*Role{}
+	for name, perms := range DefaultRoles {
+		role := &Role{Permissions: perms}
+		role.perm, _ = permissions(perms)
+		p.roles[name] = role
+	}
+	for name, role := range p.Roles {
+		if role == nil {
+			role = &Role{}
+		}
+		if err := role.validate(); err != nil {
+			return nil, fmt.Errorf("invalid role %q: %v", name, err)
+		}
+		p.roles[name] = role
+	}
+
+	var err error
+	jobPolicies := map[string]*Policy{}
+	for i, group := range p.Groups {
+		if group == nil || len(group.Name) == 0 {
+			return nil, fmt.Errorf("invalid policy: group %d has no name", i)
+		}
+		if group.perm, err = p.rolePermissions(group.Roles); err != nil {
+			return nil, fmt.Errorf("invalid group %q: %v", group.Name, err)
+		}
+		if group.Policy != nil {
+			if len(group.Policy.Permissions) != 0 || len(group.Policy.Roles) != 0 {
+				return nil, fmt.Errorf("invalid group %q: the job policy grants permissions", group.Name)
+			}
+			if err := group.Policy.validate(); err != nil {
+				return nil, fmt.Errorf("invalid policy of group %q: %v", group.Name, err)
+			}
+			jobPolicies["group "+group.Name] = group.Policy
+		}
+	}
+	for clientID, policy := range p.Clients {
+		if policy == nil {
+			policy = &Policy{}
+			p.Clients[clientID] = policy
+		}
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy of %q: %v", clientID, err)
+		}
+		perm, err := p.rolePermissions(policy.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy of %q: %v", clientID, err)
+		}
+		policy.perm |= perm
+		jobPolicies[clientID] = policy
+	}
+	if err := checkIDMaps(jobPolicies); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	return p, nil
+}
+
+// permissions converts the permission names to a bitmap.
+func permissions(names []string) (int, error) {
+	perm := 0
+	for _, name := range names {
+		bit, ok := PermNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perm |= bit
+	}
+	return perm, nil
+}
+
+// rolePermissions returns the permission bitmap of the roles.
+func (p *Policies) rolePermissions(roles []string) (int, error) {
+	perm := 0
+	for _, name := range roles {
+		role, ok := p.roles[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown role %q", name)
+		}
+		perm |= role.perm
+	}
+	return perm, nil
+}
+
+// unrestrictedRole reports whether any of the roles grants starting jobs or commands
+// without executable rules.
+func (p *Policies) unrestrictedRole(roles []string) bool {
+	for _, name := range roles {
+		if role, ok := p.roles[name]; ok && role.perm&(PermStart|PermExec) != 0 && len(role.Executables) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// roleExecutables returns the executable rules of the roles.
+func (p *Policies) roleExecutables(roles []string) []*ExecRule {
+	rules := []*ExecRule{}
+	for _, name := range roles {
+		if role, ok := p.roles[name]; ok {
+			rules = append(rules, role.Executables...)
+		}
+	}
+	return rules
+}
+
+// validate resolves the permission bitmap and compiles the executable rules of the role.
+func (r *Role) validate() error {
+	var err error
+	if r.perm, err = permissions(r.Permissions); err != nil {
+		return err
+	}
+	return compileExecRules(r.Executables)
+}
+
+func compileExecRules(rules []*ExecRule) error {
+	for _, rule := range rules {
+		if rule == nil {
+			return fmt.Errorf("empty executable rule")
+		}
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks the policy settings and resolves the permission bitmap.
+func (p *Policy) validate() error {
+	var err error
+	if p.perm, err = permissions(p.Permissions); err != nil {
+		return err
+	}
+	for _, rule := range p.Mounts {
+		if !filepath.IsAbs(rule.Path) {
+			return fmt.Errorf("mount path %q is not an absolute path", rule.Path)
+		}
+	}
+	for _, pattern := range p.Devices {
+		if _, err := filepath.Match(pattern, ""); err != nil || !filepath.IsAbs(pattern) {
+			return fmt.Errorf("invalid device pattern %q", pattern)
+		}
+	}
+	for _, name := range p.SeccompProfiles {
+		if name != SeccompUnconfined && !validProfileName(name) {
+			return fmt.Errorf("invalid seccomp profile name %q", name)
+		}
+	}
+	for _, name := range p.Capabilities {
+		if _, err := capability.Parse(name); err != nil {
+			return err
+		}
+	}
+	if err := compileExecRules(p.Executables); err != nil {
+		return err
+	}
+	if p.IDMapBase != 0 && uint64(p.IDMapBase)+IDMapSize > 1<<32-1 {
+		return fmt.Errorf("ID map base %d is too large", p.IDMapBase)
+	}
+	if p.MaxCPUs < 0 {
+		return fmt.Errorf("invalid CPU quota ceiling %g", p.MaxCPUs)
+	}
+	return nil
+}
+
+// checkIDMaps verifies the user namespace ID ranges of the job policies do not overlap,
+// as the jobs of different clients would share the host IDs.
+func checkIDMaps(policies map[string]*Policy) error {
+	owners := []string{}
+	for owner, policy := range policies {
+		if policy.IDMapBase != 0 {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return policies[owners[i]].IDMapBase < policies[owners[j]].IDMapBase
+	})
+	for i := 1; i < len(owners); i++ {
+		if policies[owners[i-1]].IDMapBase+IDMapSize > policies[owners[i]].IDMapBase {
+			return fmt.Errorf("ID maps of %q and %q overlap", owners[i-1], owners[i])
+		}
+	}
+	return nil
+}
+
+// grant is what the policies grant to an identity.
+type grant struct {
+	// perm is the permission bitmap
+	perm int
+	// policy is the job policy, nil if none applies
+	policy *Policy
+	// groups are the names of the groups of the identity
+	groups []string
+	// executables are the executable rules of the policies and the roles of the identity,
+	// none if the executables are not restricted, e.g. by a role of the identity without rules
+	executables []*ExecRule
+}
+
+// resolve collects the permissions and the executable rules of the identity from its client policy,
+// its roles and its groups, and selects its job policy. A role granting start or exec without
+// executable rules overrides the rules, so joining a restricted group does not restrict an admin.
+func (p *Policies) resolve(id Identity) grant {
+	g := grant{}
+	unrestricted := false
+	if policy, ok := p.Clients[id.ID]; ok {
+		g.perm, g.policy = policy.perm, policy
+		g.executables = append(append(g.executables, policy.Executables...), p.roleExecutables(policy.Roles)...)
+		unrestricted = p.unrestrictedRole(policy.Roles)
+	}
+	for _, group := range p.Groups {
+		if !group.matches(id) {
+			continue
+		}
+		g.perm |= group.perm
+		g.groups = append(g.groups, group.Name)
+		g.executables = append(g.executables, p.roleExecutables(group.Roles)...)
+		unrestricted = unrestricted || p.unrestrictedRole(group.Roles)
+		if group.Policy != nil {
+			g.executables = append(g.executables, group.Policy.Executables...)
+		}
+		if g.policy == nil {
+			g.policy = group.Policy
+		}
+	}
+	if unrestricted {
+		g.executables = nil
+	}
+	return g
+}
+
+// matches reports whether the identity is a member of the group.
+func (g *Group) matches(id Identity) bool {
+	return containsString(g.Members, id.ID) || containsAny(g.CertGroups, id.Groups) || containsAny(g.SANs, id.SANs)
+}
+
+func containsAny(list, items []string) bool {
+	for _, item := range items {
+		if containsString(list, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPolicies replaces the policy table. The running jobs are kept,
+// the new policies apply to the API calls that follow.
+func (m *ProcManager) SetPolicies(policies *Policies) {
+	m.policyMutex.Lock()
+	defer m.policyMutex.Unlock()
+	m.policies = policies
+}
+
+// grant returns what the current policies grant to the identity.
+func (m *ProcManager) grant(id Identity) grant {
+	m.policyMutex.RLock()
+	defer m.policyMutex.RUnlock()
+	if m.policies == nil {
+		return grant{}
+	}
+	return m.policies.resolve(id)
+}
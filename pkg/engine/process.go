@@ -1,16 +1,22 @@
 package engine
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 
 	"github.com/google/uuid"
 
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+	"github.com/dmitsh/gravitest/pkg/image"
 	"github.com/dmitsh/gravitest/proto"
 )
 
@@ -19,18 +25,41 @@ const (
 	PermStop   = 0x02
 	PermStatus = 0x04
 	PermStream = 0x08
+	PermPause  = 0x10
+	PermResume = 0x20
+	PermExec   = 0x40
+	PermUpdate = 0x80
+	// PermCrossTenant allows listing, inspecting, streaming and stopping the jobs of other clients
+	PermCrossTenant = 0x100
+	// PermShare allows sharing the client's jobs with other clients
+	PermShare = 0x200
 )
 
+// dataDir holds the rootfs images, their unpacked layers and the job writable layers
+const dataDir = "/var/lib/gravitest"
+
 var (
 	ErrProcNotFound = errors.New("process not found")
 	ErrPermDenied   = errors.New("permission denied")
+	// ErrLimitExceeded is returned for jobs requesting more resources than the server allows
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrInvalidState is returned for operations the process does not support in its current state
+	ErrInvalidState = errors.New("invalid process state")
+	// ErrInvalidArgument is returned for malformed requests
+	ErrInvalidArgument = errors.New("invalid argument")
 )
 
 type Process struct {
+	// clientID is the job owner
 	clientID string
+	command  []string
+	opts     JobOptions
 	cmd      *exec.Cmd
+	cgroup   *cgroup.Cgroup
 	output   *BufWriter
 	status   proto.Status
+	history  []Event
+	shares   []Share
 }
 
 // TRADE OFF
@@ -41,17 +70,30 @@ type ProcManager struct {
 	procs     map[string]*Process
 	procMutex sync.Mutex
 
-	// permission table [client ID : permission bitmap]
-	perm map[string]int
+	// authorization table, replaced as a whole by SetPolicies
+	policies    *Policies
+	policyMutex sync.RWMutex
+
+	config Config
+	cpus   *cpuAllocator
+	bridge *Bridge
+	images *image.Store
 }
 
-func NewProcManager() *ProcManager {
+func NewProcManager(config Config) *ProcManager {
+	if config.Rlimits == nil {
+		config.Rlimits = DefaultRlimits
+	}
+	if len(config.ImageDir) == 0 {
+		config.ImageDir = filepath.Join(dataDir, "images")
+	}
 	return &ProcManager{
-		procs: make(map[string]*Process),
-		perm: map[string]int{
-			"client1": PermStart | PermStop | PermStatus | PermStream,
-			"client2": PermStart | PermStop | PermStream,
-		},
+		procs:    make(map[string]*Process),
+		policies: config.Policies,
+		config:   config,
+		cpus:     newCPUAllocator(config.ExclusiveCPUs),
+		bridge:   NewBridge(),
+		images:   image.NewStore(config.ImageDir, filepath.Join(dataDir, "layers")),
 	}
 }
 
@@ -65,28 +107,85 @@ func (m *ProcManager) addProcess(uid string, proc *Process) {
 	m.procs[uid] = proc
 }
 
-func (m *ProcManager) checkPermission(clientID string, ask int) error {
-	if perm, ok := m.perm[clientID]; !ok || (perm&ask == 0) {
+// CheckPermission returns ErrPermDenied unless the identity holds the ask permission.
+// The callers check the permission of each API before calling the process manager,
+// whose methods only check that the client owns or shares the job.
+func (m *ProcManager) CheckPermission(id Identity, ask int) error {
+	if m.grant(id).perm&ask == 0 {
+		id.deny()
 		return ErrPermDenied
 	}
 	return nil
 }
 
-func (m *ProcManager) StartProcess(clientID, exe string, args ...string) (string, error) {
-	if err := m.checkPermission(clientID, PermStart); err != nil {
+func (m *ProcManager) StartProcess(id Identity, jobOpts *JobOptions, exe string, args ...string) (string, error) {
+	opts := JobOptions{}
+	if jobOpts != nil {
+		opts = *jobOpts
+		// the policy check resolves the mounts and the devices in place
+		opts.Mounts = append([]Mount(nil), jobOpts.Mounts...)
+		opts.Devices = append([]Device(nil), jobOpts.Devices...)
+	}
+	if len(opts.Network) == 0 {
+		opts.Network = NetworkNone
+	}
+	switch opts.Network {
+	case NetworkNone, NetworkHost, NetworkBridged:
+	default:
+		return "", fmt.Errorf("%w: network mode %q", ErrInvalidArgument, opts.Network)
+	}
+	if len(opts.Hostname) != 0 && !validHostname(opts.Hostname) {
+		return "", fmt.Errorf("%w: hostname %q", ErrInvalidArgument, opts.Hostname)
+	}
+	if err := m.applyPolicy(id, &opts); err != nil {
+		return "", err
+	}
+	var err error
+	if exe, err = m.grant(id).checkExecutable(exe, args, len(opts.Rootfs) == 0); err != nil {
+		return "", err
+	}
+	if err := m.applyRlimits(&opts); err != nil {
+		return "", err
+	}
+	if opts.seccomp, err = m.seccompProfile(opts.Seccomp); err != nil {
 		return "", err
 	}
-
 	uid := m.generateUID()
+	if len(opts.Hostname) == 0 {
+		opts.Hostname = strings.SplitN(uid, "-", 2)[0]
+	}
+	if len(opts.Rootfs) != 0 {
+		if err := m.prepareRootfs(uid, &opts); err != nil {
+			return "", err
+		}
+	}
+	if opts.Network == NetworkBridged {
+		if opts.addr, opts.gateway, err = m.bridge.Allocate(); err != nil {
+			os.RemoveAll(opts.jobDir)
+			return "", err
+		}
+	}
+	if err := m.assignCPUs(&opts); err != nil {
+		m.releaseResources(&Process{opts: opts})
+		return "", err
+	}
+
+	cgroupName := "worker-" + uid
+	runnerArgs := append(append([]string{"start"}, opts.runnerArgs()...), cgroupName, exe)
 	proc := &Process{
-		clientID: clientID,
-		cmd:      exec.Command("./runner", append([]string{"start", "worker-" + uid, exe}, args...)...),
+		clientID: id.ID,
+		command:  append([]string{exe}, args...),
+		opts:     opts,
+		cmd:      exec.Command("./runner", append(runnerArgs, args...)...),
+		cgroup:   cgroup.New(cgroupName),
 		output:   NewBufWriter(),
 		status: proto.Status{
 			ProcStatus: proto.Status_StatusNotStarted,
 		},
 	}
 
+	proc.record(id.ID, "started with memory %d bytes, CPU shares %d, CPU quota %s", opts.Memory, opts.CPUShares, formatCPUs(opts.CPUs))
+
 	proc.cmd.Stdout = proc.output
 	proc.cmd.Stderr = proc.output
 	proc.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -94,7 +193,19 @@ func (m *ProcManager) StartProcess(clientID, exe string, args ...string) (string
 	m.addProcess(uid, proc)
 
 	go func() {
-		err := proc.cmd.Start()
+		defer m.releaseResources(proc)
+
+		// the runner reports the exit status of the user command on the pipe
+		reportR, reportW, err := os.Pipe()
+		if err != nil {
+			log.Printf("failed to create report pipe: %v", err)
+			return
+		}
+		defer reportR.Close()
+		proc.cmd.ExtraFiles = []*os.File{reportW}
+
+		err = proc.cmd.Start()
+		reportW.Close()
 		if err != nil {
 			log.Printf("failed to start %q : %v", strings.Join(append([]string{exe}, args...), " "), err)
 			return
@@ -104,11 +215,16 @@ func (m *ProcManager) StartProcess(clientID, exe string, args ...string) (string
 		m.procMutex.Unlock()
 
 		err = proc.cmd.Wait()
+		report, reportErr := readReport(reportR)
 		m.procMutex.Lock()
 		proc.status.ProcStatus = proto.Status_StatusStopped
 		proc.output.Close()
 
-		if err != nil {
+		if reportErr == nil {
+			proc.status.ExitStatus = int32(report.ExitStatus)
+			proc.status.Signal = int32(report.Signal)
+			proc.status.Seccomp = report.Seccomp
+		} else if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				proc.status.ExitStatus = int32(exitErr.ProcessState.ExitCode())
 				if osStatus, ok := proc.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && osStatus.Signaled() {
@@ -127,48 +243,173 @@ func (m *ProcManager) StartProcess(clientID, exe string, args ...string) (string
 	return uid, nil
 }
 
-func (m *ProcManager) StopProcess(clientID, uid string) error {
-	if err := m.checkPermission(clientID, PermStop); err != nil {
+// exitReport is the exit status of the user command reported by the runner.
+type exitReport struct {
+	ExitStatus int  `json:"exitStatus"`
+	Signal     int  `json:"signal"`
+	Seccomp    bool `json:"seccomp"`
+}
+
+// readReport reads the runner exit report, which is missing if the runner
+// has failed before running the user command or has been killed.
+func readReport(r io.Reader) (*exitReport, error) {
+	report := &exitReport{}
+	if err := json.NewDecoder(r).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// prepareRootfs unpacks the job rootfs image and creates the job directory
+// holding the writable layer and the rootfs mount point.
+func (m *ProcManager) prepareRootfs(uid string, opts *JobOptions) error {
+	layers, err := m.images.Layers(opts.Rootfs)
+	if errors.Is(err, image.ErrInvalidImage) {
+		return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	if err != nil {
 		return err
 	}
+	jobDir := filepath.Join(dataDir, "jobs", uid)
+	for _, dir := range []string{"rootfs", "upper", "work"} {
+		if err := os.MkdirAll(filepath.Join(jobDir, dir), 0755); err != nil {
+			os.RemoveAll(jobDir)
+			return err
+		}
+	}
+	opts.layers, opts.jobDir = layers, jobDir
+	return nil
+}
+
+// releaseResources returns the resources assigned to a terminated job.
+func (m *ProcManager) releaseResources(proc *Process) {
+	if proc.opts.Network == NetworkBridged {
+		m.bridge.Release(proc.opts.addr)
+	}
+	m.cpus.Release(proc.opts.exclusive)
+	if len(proc.opts.jobDir) != 0 {
+		if err := os.RemoveAll(proc.opts.jobDir); err != nil {
+			log.Printf("failed to remove %q : %v", proc.opts.jobDir, err)
+		}
+	}
+}
+
+func (m *ProcManager) StopProcess(id Identity, uid string) error {
 	m.procMutex.Lock()
 	defer m.procMutex.Unlock()
-	proc, ok := m.procs[uid]
-	if !ok || proc.clientID != clientID {
-		return ErrProcNotFound
+	proc, crossTenant, err := m.anyProcess(id, uid, AccessControl)
+	if err != nil {
+		return err
 	}
-	if proc.status.ProcStatus == proto.Status_StatusRunning {
+	if crossTenant {
+		proc.record(id.ID, "stop requested by a cross-tenant client")
+	} else if proc.clientID != id.ID {
+		proc.record(id.ID, "stop requested")
+	}
+	switch proc.status.ProcStatus {
+	case proto.Status_StatusRunning:
 		return syscall.Kill(-proc.cmd.Process.Pid, syscall.SIGKILL)
+	case proto.Status_StatusPaused:
+		if err := syscall.Kill(-proc.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			return err
+		}
+		// frozen processes only die once thawed
+		return proc.cgroup.Thaw()
 	}
 	return nil
 }
 
-func (m *ProcManager) StatusProcess(clientID, uid string) (*proto.Status, error) {
-	if err := m.checkPermission(clientID, PermStatus); err != nil {
-		return nil, err
+// SignalProcess sends a signal to a running or paused job, which the runner
+// forwards to the job command, or to all the job processes for the signals
+// that cannot be caught. The signals of a paused job are delivered once it is resumed.
+func (m *ProcManager) SignalProcess(id Identity, uid string, sig syscall.Signal) error {
+	if sig <= 0 || sig > 64 {
+		return fmt.Errorf("%w: signal %d", ErrInvalidArgument, sig)
+	}
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	proc, crossTenant, err := m.anyProcess(id, uid, AccessControl)
+	if err != nil {
+		return err
+	}
+	switch proc.status.ProcStatus {
+	case proto.Status_StatusRunning, proto.Status_StatusPaused:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidState, proc.status.ProcStatus)
+	}
+	if crossTenant {
+		proc.record(id.ID, "signal %s sent by a cross-tenant client", sig)
+	} else if proc.clientID != id.ID {
+		proc.record(id.ID, "signal %s sent", sig)
+	}
+	switch sig {
+	case syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGCONT:
+		// the runner cannot forward the signals it cannot catch
+		return syscall.Kill(-proc.cmd.Process.Pid, sig)
+	}
+	return syscall.Kill(proc.cmd.Process.Pid, sig)
+}
+
+// PauseProcess stops all the processes of a running job with the cgroup freezer.
+func (m *ProcManager) PauseProcess(id Identity, uid string) error {
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	proc, err := m.ownProcess(id, uid)
+	if err != nil {
+		return err
+	}
+	if proc.status.ProcStatus != proto.Status_StatusRunning {
+		return fmt.Errorf("%w: %s", ErrInvalidState, proc.status.ProcStatus)
+	}
+	if err := proc.cgroup.Freeze(); err != nil {
+		return err
 	}
+	proc.status.ProcStatus = proto.Status_StatusPaused
+	return nil
+}
+
+// ResumeProcess resumes a job paused by PauseProcess.
+func (m *ProcManager) ResumeProcess(id Identity, uid string) error {
 	m.procMutex.Lock()
 	defer m.procMutex.Unlock()
-	proc, ok := m.procs[uid]
-	if !ok || proc.clientID != clientID {
-		return nil, ErrProcNotFound
+	proc, err := m.ownProcess(id, uid)
+	if err != nil {
+		return err
+	}
+	if proc.status.ProcStatus != proto.Status_StatusPaused {
+		return fmt.Errorf("%w: %s", ErrInvalidState, proc.status.ProcStatus)
+	}
+	if err := proc.cgroup.Thaw(); err != nil {
+		return err
+	}
+	proc.status.ProcStatus = proto.Status_StatusRunning
+	return nil
+}
+
+func (m *ProcManager) StatusProcess(id Identity, uid string) (*proto.Status, error) {
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	proc, _, err := m.anyProcess(id, uid, AccessRead)
+	if err != nil {
+		return nil, err
 	}
 	return &proto.Status{
 		ProcStatus: proc.status.ProcStatus,
 		ExitStatus: proc.status.ExitStatus,
 		Signal:     proc.status.Signal,
+		Seccomp:    proc.status.Seccomp,
+		History:    proc.protoHistory(),
+		Owner:      proc.clientID,
+		Shares:     proc.protoShares(),
 	}, nil
 }
 
-func (m *ProcManager) StreamOutput(clientID, uid string) (io.Reader, error) {
-	if err := m.checkPermission(clientID, PermStream); err != nil {
-		return nil, err
-	}
+func (m *ProcManager) StreamOutput(id Identity, uid string) (io.ReadCloser, error) {
 	m.procMutex.Lock()
 	defer m.procMutex.Unlock()
-	proc, ok := m.procs[uid]
-	if !ok || proc.clientID != clientID {
-		return nil, ErrProcNotFound
+	proc, _, err := m.anyProcess(id, uid, AccessRead)
+	if err != nil {
+		return nil, err
 	}
 	return NewBufReader(proc.output), nil
 }
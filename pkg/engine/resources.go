@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dmitsh/gravitest/pkg/cgroup"
+	"github.com/dmitsh/gravitest/proto"
+)
+
+// DefaultMemory and DefaultCPUShares are the limits of the jobs not requesting their own.
+const (
+	DefaultMemory    = 10 << 20
+	DefaultCPUShares = 512
+)
+
+// the cpu.shares range accepted by cgroup v1
+const (
+	minCPUShares = 2
+	maxCPUShares = 262144
+)
+
+// Resources are the job limits that can be changed while the job runs.
+// Zero values leave the corresponding limits unchanged, so a limit can be
+// changed but not removed, e.g. a job with a CPU quota keeps one.
+type Resources struct {
+	// Memory limits the job memory usage in bytes
+	Memory uint64
+	// CPUShares is the relative CPU weight of the job
+	CPUShares uint64
+	// CPUs is the hard CPU quota of the job in CPUs
+	CPUs float64
+}
+
+// Event is an entry of the job history.
+type Event struct {
+	Time time.Time
+	// ClientID is the client that caused the event
+	ClientID string
+	Message  string
+}
+
+// record adds an event to the job history, the caller must hold procMutex
+// once the process is in the process table.
+func (p *Process) record(clientID, format string, args ...interface{}) {
+	p.history = append(p.history, Event{
+		Time:     time.Now(),
+		ClientID: clientID,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// protoHistory converts the job history to its API representation.
+func (p *Process) protoHistory() []*proto.Event {
+	history := make([]*proto.Event, 0, len(p.history))
+	for _, event := range p.history {
+		history = append(history, &proto.Event{
+			Time:     event.Time.Unix(),
+			ClientId: event.ClientID,
+			Message:  event.Message,
+		})
+	}
+	return history
+}
+
+// checkResources verifies the job resources against the client ceilings.
+func (p *Policy) checkResources(r Resources) error {
+	if r.CPUShares != 0 && (r.CPUShares < minCPUShares || r.CPUShares > maxCPUShares) {
+		return fmt.Errorf("%w: CPU shares %d are out of range [%d, %d]", ErrInvalidArgument, r.CPUShares, minCPUShares, maxCPUShares)
+	}
+	if p.MaxMemory != 0 && r.Memory > p.MaxMemory {
+		return fmt.Errorf("%w: memory %d exceeds %d bytes", ErrLimitExceeded, r.Memory, p.MaxMemory)
+	}
+	if p.MaxCPUShares != 0 && r.CPUShares > p.MaxCPUShares {
+		return fmt.Errorf("%w: CPU shares %d exceed %d", ErrLimitExceeded, r.CPUShares, p.MaxCPUShares)
+	}
+	if p.MaxCPUs != 0 && r.CPUs > p.MaxCPUs {
+		return fmt.Errorf("%w: CPU quota %g exceeds %g CPUs", ErrLimitExceeded, r.CPUs, p.MaxCPUs)
+	}
+	return nil
+}
+
+// UpdateResources rewrites the cgroup limits of a running or paused job
+// and records the change in the job history.
+func (m *ProcManager) UpdateResources(id Identity, uid string, r Resources) error {
+	if r.Memory == 0 && r.CPUShares == 0 && r.CPUs == 0 {
+		return fmt.Errorf("%w: no resources to update", ErrInvalidArgument)
+	}
+	policy := m.grant(id).policy
+	if policy == nil {
+		return fmt.Errorf("%w: no job policy", ErrPermDenied)
+	}
+	if err := policy.checkResources(r); err != nil {
+		return err
+	}
+	var quota int64
+	if r.CPUs != 0 {
+		online, err := cgroup.OnlineCPUs()
+		if err != nil {
+			return err
+		}
+		if quota, err = cpuQuota(r.CPUs, len(online)); err != nil {
+			return err
+		}
+	}
+
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	proc, err := m.ownProcess(id, uid)
+	if err != nil {
+		return err
+	}
+	switch proc.status.ProcStatus {
+	case proto.Status_StatusRunning, proto.Status_StatusPaused:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidState, proc.status.ProcStatus)
+	}
+
+	// the limits are applied one at a time, and the applied ones are restored if a later one
+	// fails, so the job keeps either all the new limits or its previous ones. The memory goes
+	// first as the most likely to fail: the kernel reclaims the job memory down to a lower
+	// limit, and refuses the limit on cgroup v1 if it cannot.
+	updates := []resourceUpdate{}
+	if r.Memory != 0 {
+		updates = append(updates, resourceUpdate{
+			set:     cgroup.Resources{Memory: r.Memory},
+			restore: cgroup.Resources{Memory: proc.opts.Memory},
+			change:  fmt.Sprintf("memory %d -> %d bytes", proc.opts.Memory, r.Memory),
+			apply:   func() { proc.opts.Memory = r.Memory },
+		})
+	}
+	if r.CPUShares != 0 {
+		updates = append(updates, resourceUpdate{
+			set:     cgroup.Resources{CPUShares: r.CPUShares},
+			restore: cgroup.Resources{CPUShares: proc.opts.CPUShares},
+			change:  fmt.Sprintf("CPU shares %d -> %d", proc.opts.CPUShares, r.CPUShares),
+			apply:   func() { proc.opts.CPUShares = r.CPUShares },
+		})
+	}
+	if r.CPUs != 0 {
+		previous := proc.opts.cpuQuota
+		if previous == 0 {
+			previous = -1
+		}
+		updates = append(updates, resourceUpdate{
+			set:     cgroup.Resources{CPUQuota: quota},
+			restore: cgroup.Resources{CPUQuota: previous},
+			change:  fmt.Sprintf("CPU quota %s -> %s", formatCPUs(proc.opts.CPUs), formatCPUs(r.CPUs)),
+			apply:   func() { proc.opts.CPUs, proc.opts.cpuQuota = r.CPUs, quota },
+		})
+	}
+
+	for i := range updates {
+		if err = proc.cgroup.Set(&updates[i].set); err == nil {
+			continue
+		}
+		// the limits which cannot be restored stay applied, and are recorded as such
+		changes := []string{}
+		for j := i - 1; j >= 0; j-- {
+			if restoreErr := proc.cgroup.Set(&updates[j].restore); restoreErr != nil {
+				log.Printf("failed to restore the limits of %s: %v", uid, restoreErr)
+				updates[j].apply()
+				changes = append(changes, updates[j].change)
+			}
+		}
+		if len(changes) != 0 {
+			proc.record(id.ID, "resources partially updated: %s", strings.Join(changes, ", "))
+		}
+		return err
+	}
+
+	changes := []string{}
+	for _, update := range updates {
+		update.apply()
+		changes = append(changes, update.change)
+	}
+	proc.record(id.ID, "resources updated: %s", strings.Join(changes, ", "))
+	return nil
+}
+
+// resourceUpdate is the change of a job limit, along with the cgroup setting restoring
+// the previous limit and the update of the job options once applied.
+type resourceUpdate struct {
+	set, restore cgroup.Resources
+	change       string
+	apply        func()
+}
+
+// formatCPUs formats a CPU quota for the job history.
+func formatCPUs(cpus float64) string {
+	if cpus == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g CPUs", cpus)
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// RlimitInfinity is the "unlimited" rlimit value.
+const RlimitInfinity = ^uint64(0)
+
+// RlimitRange is the server side setting of a job rlimit.
+type RlimitRange struct {
+	// Default applies to the jobs not requesting the rlimit
+	Default RlimitValue `json:"default"`
+	// Max caps the value a job may request
+	Max RlimitValue `json:"max"`
+}
+
+// RlimitValue is an rlimit value decoded from either a number or "unlimited".
+type RlimitValue uint64
+
+func (v *RlimitValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "unlimited" {
+			return fmt.Errorf("invalid rlimit value %q", s)
+		}
+		*v = RlimitValue(RlimitInfinity)
+		return nil
+	}
+	var n uint64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid rlimit value %s", data)
+	}
+	*v = RlimitValue(n)
+	return nil
+}
+
+// DefaultRlimits lists the supported rlimits, named after setrlimit(2) resources
+// without the "RLIMIT_" prefix, with their built-in defaults and maximums.
+var DefaultRlimits = map[string]RlimitRange{
+	// no core dumps unless requested
+	"core":   {Default: 0, Max: 1 << 30},
+	"cpu":    {Default: RlimitValue(RlimitInfinity), Max: RlimitValue(RlimitInfinity)},
+	"fsize":  {Default: 1 << 30, Max: 16 << 30},
+	"nofile": {Default: 1024, Max: 65536},
+	"stack":  {Default: 8 << 20, Max: 64 << 20},
+	"as":     {Default: RlimitValue(RlimitInfinity), Max: RlimitValue(RlimitInfinity)},
+}
+
+// applyRlimits verifies the requested rlimits against the server maximums
+// and fills in the defaults.
+func (m *ProcManager) applyRlimits(opts *JobOptions) error {
+	for name, value := range opts.Rlimits {
+		r, ok := m.config.Rlimits[name]
+		if !ok {
+			return fmt.Errorf("%w: unknown rlimit %q", ErrInvalidArgument, name)
+		}
+		if value > uint64(r.Max) {
+			return fmt.Errorf("%w: rlimit %s %s exceeds %s", ErrLimitExceeded, name, formatRlimit(value), formatRlimit(uint64(r.Max)))
+		}
+	}
+	opts.rlimits = map[string]uint64{}
+	for name, r := range m.config.Rlimits {
+		opts.rlimits[name] = uint64(r.Default)
+		if value, ok := opts.Rlimits[name]; ok {
+			opts.rlimits[name] = value
+		}
+	}
+	return nil
+}
+
+func formatRlimit(value uint64) string {
+	if value == RlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
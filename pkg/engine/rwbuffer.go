@@ -16,6 +16,7 @@ type BufWriter struct {
 type BufReader struct {
 	writer *BufWriter
 	offs   int
+	closed bool
 }
 
 func NewBufWriter() *BufWriter {
@@ -47,7 +48,7 @@ func (w *BufWriter) Close() {
 	w.cond.Broadcast()
 }
 
-func NewBufReader(writer *BufWriter) io.Reader {
+func NewBufReader(writer *BufWriter) io.ReadCloser {
 	reader := &BufReader{
 		writer: writer,
 	}
@@ -58,6 +59,10 @@ func (r *BufReader) Read(p []byte) (int, error) {
 	r.writer.cond.L.Lock()
 	defer r.writer.cond.L.Unlock()
 
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+
 	if r.offs < len(r.writer.data) {
 		n := copy(p, r.writer.data[r.offs:])
 		r.offs += n
@@ -73,6 +78,15 @@ func (r *BufReader) Read(p []byte) (int, error) {
 	return 0, nil
 }
 
+// Close makes the pending and the following reads fail, e.g. once the client is gone.
+func (r *BufReader) Close() error {
+	r.writer.Lock()
+	r.closed = true
+	r.writer.Unlock()
+	r.writer.cond.Broadcast()
+	return nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
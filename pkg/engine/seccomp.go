@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/dmitsh/gravitest/pkg/seccomp"
+)
+
+// seccomp profile names with a built-in meaning
+const (
+	// SeccompDefault is the built-in deny-list profile, applied when no profile is requested
+	SeccompDefault = "default"
+	// SeccompUnconfined disables syscall filtering
+	SeccompUnconfined = "unconfined"
+)
+
+// seccompProfile resolves the requested profile name to the runner "-seccomp" flag value:
+// "default" for the built-in profile, a compact JSON profile loaded from the
+// "seccomp" config directory, or an empty string for the unconfined jobs.
+func (m *ProcManager) seccompProfile(name string) (string, error) {
+	switch name {
+	case SeccompDefault:
+		return SeccompDefault, nil
+	case SeccompUnconfined:
+		return "", nil
+	}
+	if !validProfileName(name) {
+		return "", fmt.Errorf("%w: seccomp profile name %q", ErrInvalidArgument, name)
+	}
+	profile, err := seccomp.Load(filepath.Join(m.config.ConfigDir, "seccomp", name+".json"))
+	if err != nil {
+		return "", fmt.Errorf("seccomp profile %q: %v", name, err)
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func validProfileName(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dmitsh/gravitest/proto"
+)
+
+// Access is the access to a job its owner grants to other clients.
+type Access int
+
+const (
+	// AccessRead allows getting the job status and streaming its output
+	AccessRead Access = iota
+	// AccessControl also allows stopping and signaling the job
+	AccessControl
+)
+
+func (a Access) String() string {
+	if a == AccessControl {
+		return "control"
+	}
+	return "read"
+}
+
+// Share grants a client or a group the access to a job.
+type Share struct {
+	// Grantee is a client ID, or a group name, i.e. a certificate O or OU or a policy group
+	Grantee string
+	Group   bool
+	Access  Access
+}
+
+// ShareProcess grants the clients and the groups the access to a job of the client,
+// replacing their previous grants, or revokes their grants.
+// The grantees still need the permissions of the APIs they call.
+func (m *ProcManager) ShareProcess(id Identity, uid string, access Access, clients, groups []string, revoke bool) error {
+	if access != AccessRead && access != AccessControl {
+		return fmt.Errorf("%w: access %d", ErrInvalidArgument, access)
+	}
+	shares := []Share{}
+	for _, client := range clients {
+		shares = append(shares, Share{Grantee: client, Access: access})
+	}
+	for _, group := range groups {
+		shares = append(shares, Share{Grantee: group, Group: true, Access: access})
+	}
+	if len(shares) == 0 {
+		return fmt.Errorf("%w: no client or group to share the job with", ErrInvalidArgument)
+	}
+	for _, share := range shares {
+		if len(strings.TrimSpace(share.Grantee)) == 0 {
+			return fmt.Errorf("%w: grantee %q", ErrInvalidArgument, share.Grantee)
+		}
+	}
+
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	proc, err := m.ownProcess(id, uid)
+	if err != nil {
+		return err
+	}
+	for _, share := range shares {
+		proc.removeShare(share)
+		if revoke {
+			proc.record(id.ID, "revoked the access of %s", share.grantee())
+		} else {
+			proc.shares = append(proc.shares, share)
+			proc.record(id.ID, "granted %s access to %s", share.Access, share.grantee())
+		}
+	}
+	return nil
+}
+
+func (s Share) grantee() string {
+	if s.Group {
+		return "group " + s.Grantee
+	}
+	return s.Grantee
+}
+
+// removeShare removes the grant of the grantee of the share, if any.
+func (p *Process) removeShare(share Share) {
+	for i, s := range p.shares {
+		if s.Grantee == share.Grantee && s.Group == share.Group {
+			p.shares = append(p.shares[:i], p.shares[i+1:]...)
+			return
+		}
+	}
+}
+
+// sharedWith reports whether the job is shared with the identity, member of the policy groups,
+// with at least the access.
+func (p *Process) sharedWith(id Identity, groups []string, access Access) bool {
+	for _, s := range p.shares {
+		if s.Access < access {
+			continue
+		}
+		if s.Group && (containsString(id.Groups, s.Grantee) || containsString(groups, s.Grantee)) {
+			return true
+		}
+		if !s.Group && s.Grantee == id.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// protoShares converts the job grants to their API representation.
+func (p *Process) protoShares() []*proto.Share {
+	shares := make([]*proto.Share, 0, len(p.shares))
+	for _, s := range p.shares {
+		shares = append(shares, &proto.Share{
+			Grantee: s.Grantee,
+			Group:   s.Group,
+			Access:  proto.ShareAccess(s.Access),
+		})
+	}
+	return shares
+}
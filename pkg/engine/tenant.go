@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dmitsh/gravitest/proto"
+)
+
+// JobInfo is the summary of a job returned by ListProcesses.
+type JobInfo struct {
+	ID string
+	// Owner is the client ID of the client that started the job
+	Owner     string
+	Status    proto.Status_ProcStatus
+	StartTime time.Time
+	Command   []string
+}
+
+// Decision is the authorization decision of an API call, recorded by the ProcManager
+// methods in Identity.Decision for the audit log of the caller.
+type Decision struct {
+	// Denied is set once a permission or a tenant check rejects the call,
+	// including the accesses to the jobs of other clients reported as not found
+	Denied bool
+	// CrossTenant is set for the accesses to the jobs of other clients allowed
+	// by PermCrossTenant, with the job Owner, which is empty when listing all the jobs
+	CrossTenant bool
+	Owner       string
+}
+
+// deny records the rejection of the call.
+func (id Identity) deny() {
+	if id.Decision != nil {
+		id.Decision.Denied = true
+	}
+}
+
+// crossTenant records a cross-tenant access to a job of owner.
+func (id Identity) crossTenant(owner string) {
+	if id.Decision != nil {
+		id.Decision.CrossTenant, id.Decision.Owner = true, owner
+	}
+}
+
+// ownProcess returns the job for an operation only its owner may perform,
+// the caller must hold procMutex.
+func (m *ProcManager) ownProcess(id Identity, uid string) (*Process, error) {
+	proc, ok := m.procs[uid]
+	if !ok {
+		return nil, ErrProcNotFound
+	}
+	if proc.clientID != id.ID {
+		id.deny()
+		return nil, ErrProcNotFound
+	}
+	return proc, nil
+}
+
+// anyProcess returns the job for an operation its owner may share with other clients
+// and clients with PermCrossTenant may perform on the jobs of other clients,
+// the caller must hold procMutex. The cross-tenant accesses are recorded in the decision.
+func (m *ProcManager) anyProcess(id Identity, uid string, access Access) (proc *Process, crossTenant bool, err error) {
+	proc, ok := m.procs[uid]
+	if !ok {
+		return nil, false, ErrProcNotFound
+	}
+	if proc.clientID == id.ID {
+		return proc, false, nil
+	}
+	grant := m.grant(id)
+	if proc.sharedWith(id, grant.groups, access) {
+		return proc, false, nil
+	}
+	if grant.perm&PermCrossTenant == 0 {
+		id.deny()
+		return nil, false, ErrProcNotFound
+	}
+	id.crossTenant(proc.clientID)
+	return proc, true, nil
+}
+
+// ListProcesses returns the jobs of the client and the jobs shared with it sorted by start time,
+// or the jobs of all the clients, which the callers allow to the clients with PermCrossTenant.
+func (m *ProcManager) ListProcesses(id Identity, all bool) ([]JobInfo, error) {
+	groups := m.grant(id).groups
+	m.procMutex.Lock()
+	defer m.procMutex.Unlock()
+	jobs := []JobInfo{}
+	for uid, proc := range m.procs {
+		if !all && proc.clientID != id.ID && !proc.sharedWith(id, groups, AccessRead) {
+			continue
+		}
+		jobs = append(jobs, JobInfo{
+			ID:        uid,
+			Owner:     proc.clientID,
+			Status:    proc.status.ProcStatus,
+			StartTime: proc.history[0].Time,
+			Command:   proc.command,
+		})
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].StartTime.Equal(jobs[j].StartTime) {
+			return jobs[i].StartTime.Before(jobs[j].StartTime)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	if all {
+		id.crossTenant("")
+	}
+	return jobs, nil
+}
@@ -0,0 +1,148 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidImage = errors.New("invalid rootfs image")
+
+// Store prepares the rootfs images of the image directory for the overlay mounts of the jobs.
+// Tarballs and OCI image layers are unpacked once into the layer directory
+// and shared as read-only lower layers by all the jobs using them.
+type Store struct {
+	// imageDir holds the images the jobs may use, managed by the server administrator
+	imageDir string
+	// dir holds the unpacked layers
+	dir string
+}
+
+func NewStore(imageDir, dir string) *Store {
+	return &Store{imageDir: imageDir, dir: dir}
+}
+
+// Layers resolves the image reference to the list of unpacked layer directories,
+// topmost layer first, as expected by the overlayfs "lowerdir" option.
+// The reference is the name of an image of the image directory, which is one of:
+//   - a directory used as is;
+//   - a tarball, optionally gzip compressed;
+//   - an OCI image layout, optionally followed by ":<tag>" to select the image.
+func (s *Store) Layers(ref string) ([]string, error) {
+	name, tag := ref, ""
+	if i := strings.Index(ref, ":"); i != -1 {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	path, err := s.imagePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no image %q", ErrInvalidImage, name)
+	}
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, ociLayoutFile)); err == nil {
+			return s.ociLayers(path, tag)
+		}
+		if len(tag) != 0 {
+			return nil, fmt.Errorf("%w: %q is not an OCI image layout", ErrInvalidImage, name)
+		}
+		return []string{path}, nil
+	}
+	if len(tag) != 0 {
+		return nil, fmt.Errorf("%w: %q is not an OCI image layout", ErrInvalidImage, name)
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := s.unpack(digest, path)
+	if err != nil {
+		return nil, err
+	}
+	return []string{dir}, nil
+}
+
+// imagePath resolves the image name, a relative path of letters, digits, '.', '-' and '_'
+// segments, to the image path, which must not lead outside of the image directory
+// through a symbolic link.
+func (s *Store) imagePath(name string) (string, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." || strings.Trim(segment, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_") != "" {
+			return "", fmt.Errorf("%w: invalid image name %q", ErrInvalidImage, name)
+		}
+	}
+	imageDir, err := filepath.EvalSymlinks(s.imageDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: no image %q", ErrInvalidImage, name)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(imageDir, name))
+	if err != nil {
+		return "", fmt.Errorf("%w: no image %q", ErrInvalidImage, name)
+	}
+	if !strings.HasPrefix(path, imageDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: image %q is outside of the image directory", ErrInvalidImage, name)
+	}
+	return path, nil
+}
+
+// unpack extracts the tarball into the store directory named after its digest,
+// unless it has been extracted already.
+func (s *Store) unpack(digest, tarball string) (string, error) {
+	dir := filepath.Join(s.dir, strings.Replace(digest, ":", "-", 1))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", err
+	}
+	// extract to a temporary directory first, so a partially extracted layer is never used
+	tmp, err := os.MkdirTemp(s.dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	f, err := os.Open(tarball)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	defer f.Close()
+	if err := extract(f, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to extract %q: %v", tarball, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		// another job has extracted the same layer concurrently
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return dir, nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,129 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeLayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDocker   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	annotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// descriptor, index and manifest are the subsets of the OCI image spec types used here
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// ociLayers unpacks the layers of the image tagged with tag in the OCI image layout.
+// An empty tag selects the only image of the layout.
+func (s *Store) ociLayers(layout, tag string) ([]string, error) {
+	var idx index
+	if err := readJSON(filepath.Join(layout, ociIndexFile), &idx); err != nil {
+		return nil, err
+	}
+
+	var desc *descriptor
+	for i, m := range idx.Manifests {
+		if len(tag) == 0 || m.Annotations[annotationRefName] == tag {
+			if desc != nil {
+				return nil, fmt.Errorf("%w: %q has several images, select one by tag", ErrInvalidImage, layout)
+			}
+			desc = &idx.Manifests[i]
+		}
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("%w: no image %q in %q", ErrInvalidImage, tag, layout)
+	}
+	// follow nested indexes down to the image manifest
+	for desc.MediaType == mediaTypeIndex {
+		var nested index
+		if err := readBlob(layout, desc.Digest, &nested); err != nil {
+			return nil, err
+		}
+		if len(nested.Manifests) == 0 {
+			return nil, fmt.Errorf("%w: empty index %s", ErrInvalidImage, desc.Digest)
+		}
+		desc = &nested.Manifests[0]
+	}
+	if desc.MediaType != mediaTypeManifest {
+		return nil, fmt.Errorf("%w: unsupported manifest type %q", ErrInvalidImage, desc.MediaType)
+	}
+
+	var m manifest
+	if err := readBlob(layout, desc.Digest, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Layers) == 0 {
+		return nil, fmt.Errorf("%w: image %s has no layers", ErrInvalidImage, desc.Digest)
+	}
+
+	// the manifest lists the base layer first, overlayfs expects the topmost first
+	layers := make([]string, len(m.Layers))
+	for i, layer := range m.Layers {
+		switch layer.MediaType {
+		case mediaTypeLayer, mediaTypeLayerGz, mediaTypeDocker:
+		default:
+			return nil, fmt.Errorf("%w: unsupported layer type %q", ErrInvalidImage, layer.MediaType)
+		}
+		blob, err := blobPath(layout, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := s.unpack(layer.Digest, blob)
+		if err != nil {
+			return nil, err
+		}
+		layers[len(m.Layers)-1-i] = dir
+	}
+	return layers, nil
+}
+
+// blobPath returns the path of the blob with the digest in the form "<algorithm>:<hex>".
+func blobPath(layout, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 || strings.ContainsAny(digest, "/\\.") {
+		return "", fmt.Errorf("%w: invalid digest %q", ErrInvalidImage, digest)
+	}
+	return filepath.Join(layout, "blobs", parts[0], parts[1]), nil
+}
+
+func readBlob(layout, digest string, v interface{}) error {
+	path, err := blobPath(layout, digest)
+	if err != nil {
+		return err
+	}
+	return readJSON(path, v)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidImage, path, err)
+	}
+	return nil
+}
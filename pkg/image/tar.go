@@ -0,0 +1,181 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// extract unpacks the tar stream, optionally gzip compressed, into dir.
+// OCI whiteout entries are converted to their overlayfs representation.
+// The entries are owned by the server user and lose their setuid and setgid bits,
+// and the device nodes are skipped, so an image cannot grant the jobs more than
+// their own credential and device policy do.
+func extract(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// directory times are restored last, as extracting their content updates them
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	dirTimes := []dirTime{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		base := filepath.Base(path)
+		if base == whiteoutOpaque {
+			// the directory hides the content of the lower layers
+			if err := syscall.Setxattr(filepath.Dir(path), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			// the entry is deleted in this layer: overlayfs uses a 0/0 character device
+			target := filepath.Join(filepath.Dir(path), strings.TrimPrefix(base, whiteoutPrefix))
+			os.RemoveAll(target)
+			if err := syscall.Mknod(target, syscall.S_IFCHR, 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// an entry replaces whatever the archive has created at the same path before
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+
+		mode := uint32(hdr.Mode & 07777)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			dirTimes = append(dirTimes, dirTime{path, hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := safeJoin(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeFifo:
+			if err := syscall.Mknod(path, syscall.S_IFIFO|mode&0777, 0); err != nil {
+				return err
+			}
+		default:
+			// skip the device nodes, the job /dev holds the devices it may use,
+			// and the metadata entries, such as PAX and GNU headers
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if err := os.Chmod(path, os.FileMode(mode&0777)|modeBits(mode)); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		os.Chtimes(dirTimes[i].path, dirTimes[i].mtime, dirTimes[i].mtime)
+	}
+	return nil
+}
+
+// modeBits converts the sticky bit to os.FileMode, dropping the setuid and setgid bits.
+func modeBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// safeJoin joins the archive entry name to dir, rejecting names escaping dir
+// either directly or through a symbolic link created by an earlier entry.
+func safeJoin(dir, name string) (string, error) {
+	path := filepath.Join(dir, filepath.Clean("/"+name))
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return dir, nil
+	}
+	// the entry itself may be a symlink, but none of its parents
+	parts := strings.Split(rel, string(filepath.Separator))
+	cur := dir
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		if fi, err := os.Lstat(cur); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry %q is below a symbolic link", name)
+		}
+	}
+	return path, nil
+}
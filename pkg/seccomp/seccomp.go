@@ -0,0 +1,352 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Action is what the filter does when a syscall matches.
+type Action string
+
+const (
+	// ActAllow lets the syscall run
+	ActAllow Action = "allow"
+	// ActErrno fails the syscall with the rule errno, EPERM by default
+	ActErrno Action = "errno"
+	// ActKill kills the process with SIGSYS
+	ActKill Action = "kill"
+	// ActLog lets the syscall run and logs it to the kernel audit log
+	ActLog Action = "log"
+)
+
+var ErrUnsupportedArch = errors.New("seccomp filters are not supported on " + runtime.GOARCH)
+
+// Op compares a syscall argument with the rule value.
+type Op string
+
+const (
+	// OpEqual matches the argument equal to the value
+	OpEqual Op = "eq"
+	// OpNotEqual matches the argument not equal to the value
+	OpNotEqual Op = "ne"
+	// OpMaskedAny matches the argument with any of the value bits set
+	OpMaskedAny Op = "maskedAny"
+)
+
+// Profile is a seccomp filter in the form of a syscall deny or allow list.
+//
+//	{
+//	  "defaultAction": "allow",
+//	  "syscalls": [
+//	    {"names": ["mount", "umount2"], "action": "errno", "errno": 1},
+//	    {"names": ["kexec_load"], "action": "kill"},
+//	    {"names": ["clone"], "action": "kill", "args": [{"index": 0, "op": "maskedAny", "value": 2114060288}]}
+//	  ]
+//	}
+type Profile struct {
+	DefaultAction Action `json:"defaultAction"`
+	Syscalls      []Rule `json:"syscalls"`
+}
+
+// Rule applies the action to the listed syscalls, or only to their calls
+// with all the argument conditions met.
+type Rule struct {
+	Names  []string `json:"names"`
+	Action Action   `json:"action"`
+	Errno  uint16   `json:"errno,omitempty"`
+	Args   []Arg    `json:"args,omitempty"`
+}
+
+// Arg is a condition on the syscall argument with the index, counted from 0.
+type Arg struct {
+	Index uint   `json:"index"`
+	Op    Op     `json:"op"`
+	Value uint64 `json:"value"`
+}
+
+// cloneNewFlags are the clone flags creating namespaces, see <linux/sched.h>:
+// CLONE_NEWNS, CLONE_NEWCGROUP, CLONE_NEWUTS, CLONE_NEWIPC, CLONE_NEWUSER, CLONE_NEWPID
+// and CLONE_NEWNET. CLONE_NEWTIME is only accepted by unshare and clone3.
+const cloneNewFlags = 0x7e020000
+
+// Default is the built-in profile killing the jobs calling the syscalls,
+// which could affect the host or escape the job isolation.
+// The syscalls missing on the current architecture are left out.
+var Default = &Profile{
+	DefaultAction: ActAllow,
+	Syscalls: []Rule{
+		{
+			Action: ActKill,
+			Names: available(
+				"acct", "add_key", "bpf", "clock_adjtime", "clock_settime", "create_module",
+				"delete_module", "finit_module", "fsconfig", "fsmount", "fsopen", "fspick",
+				"get_kernel_syms", "init_module", "ioperm", "iopl", "kexec_file_load", "kexec_load",
+				"keyctl", "lookup_dcookie", "mount", "mount_setattr", "move_mount", "name_to_handle_at",
+				"nfsservctl", "open_by_handle_at", "open_tree", "perf_event_open", "pivot_root",
+				"process_vm_readv", "process_vm_writev", "ptrace", "query_module", "quotactl",
+				"quotactl_fd", "reboot", "request_key", "setns", "settimeofday", "swapoff", "swapon",
+				"_sysctl", "syslog", "umount2", "unshare", "uselib", "userfaultfd", "ustat", "vhangup",
+			),
+		},
+		{
+			// the threads and the processes are still created with clone
+			Action: ActKill,
+			Names:  available("clone"),
+			Args:   []Arg{{Index: 0, Op: OpMaskedAny, Value: cloneNewFlags}},
+		},
+		{
+			// the clone3 flags are passed in memory, out of the filter reach;
+			// the C libraries fall back to clone on ENOSYS
+			Action: ActErrno,
+			Errno:  uint16(syscall.ENOSYS),
+			Names:  available("clone3"),
+		},
+	},
+}
+
+// available returns the names of the syscalls of the current architecture.
+func available(names ...string) []string {
+	var list []string
+	for _, name := range names {
+		if _, ok := syscallNumbers[name]; ok {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// Load reads and validates a JSON profile.
+func Load(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a JSON profile.
+func Parse(data []byte) (*Profile, error) {
+	profile := &Profile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile: %v", err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// Validate checks the actions, the syscall names and the argument conditions of the profile.
+func (p *Profile) Validate() error {
+	if !validAction(p.DefaultAction) {
+		return fmt.Errorf("invalid seccomp default action %q", p.DefaultAction)
+	}
+	for _, rule := range p.Syscalls {
+		if !validAction(rule.Action) {
+			return fmt.Errorf("invalid seccomp action %q", rule.Action)
+		}
+		for _, name := range rule.Names {
+			if _, ok := syscallNumbers[name]; !ok {
+				return fmt.Errorf("unknown syscall %q on %s", name, runtime.GOARCH)
+			}
+		}
+		for _, arg := range rule.Args {
+			if arg.Index >= maxArgs {
+				return fmt.Errorf("invalid seccomp argument index %d", arg.Index)
+			}
+			if !validOp(arg.Op) {
+				return fmt.Errorf("invalid seccomp argument operator %q", arg.Op)
+			}
+		}
+	}
+	return nil
+}
+
+func validOp(op Op) bool {
+	switch op {
+	case OpEqual, OpNotEqual, OpMaskedAny:
+		return true
+	}
+	return false
+}
+
+func validAction(action Action) bool {
+	switch action {
+	case ActAllow, ActErrno, ActKill, ActLog:
+		return true
+	}
+	return false
+}
+
+// seccomp filter return values, see <linux/seccomp.h>
+const (
+	retKillProcess = 0x80000000
+	retErrno       = 0x00050000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+
+	// offsets in struct seccomp_data
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	// offsets of the 32-bit halves of the arguments, the supported architectures are little-endian
+	argLowOffset  = 0
+	argHighOffset = 4
+
+	// number of the syscall arguments in struct seccomp_data
+	maxArgs = 6
+
+	// x32 syscalls share the x86_64 audit arch and have this bit set
+	x32SyscallBit = 0x40000000
+)
+
+// Compile converts the profile to a BPF program. Like Validate, it rejects
+// the syscalls missing on the current architecture; the foreign architecture
+// calls are killed.
+func (p *Profile) Compile() ([]unix.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, ErrUnsupportedArch
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, retKillProcess),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr),
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, retKillProcess))
+	}
+	for _, rule := range p.Syscalls {
+		ret := action(rule.Action, rule.Errno)
+		checks, err := argChecks(rule.Args)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Names {
+			nr := syscallNumbers[name]
+			if len(checks) == 0 {
+				prog = append(prog,
+					jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+					stmt(unix.BPF_RET|unix.BPF_K, ret))
+				continue
+			}
+			// the argument checks load the arguments, so the unmatched calls
+			// land on the reload of the syscall number
+			prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, uint8(len(checks)+1)))
+			prog = append(prog, checks...)
+			prog = append(prog,
+				stmt(unix.BPF_RET|unix.BPF_K, ret),
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr))
+		}
+	}
+	prog = append(prog, stmt(unix.BPF_RET|unix.BPF_K, action(p.DefaultAction, 0)))
+	if len(prog) > 4096 {
+		return nil, fmt.Errorf("seccomp profile is too large")
+	}
+	return prog, nil
+}
+
+// Install compiles the profile and applies it to the calling thread,
+// which must be locked with runtime.LockOSThread and exec right after.
+// It sets no_new_privs, as required for unprivileged callers.
+func (p *Profile) Install() error {
+	prog, err := p.Compile()
+	if err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %v", err)
+	}
+	return nil
+}
+
+// argChecks compiles the argument conditions to the instructions falling through
+// when all of them are met, and jumping over the instruction following them otherwise.
+// The 64-bit arguments are compared by their 32-bit halves.
+func argChecks(args []Arg) ([]unix.SockFilter, error) {
+	var prog []unix.SockFilter
+	// the indexes of the instructions jumping to the failure when true or false
+	var failTrue, failFalse []int
+	for _, arg := range args {
+		low := offsetArgs + 8*uint32(arg.Index) + argLowOffset
+		high := offsetArgs + 8*uint32(arg.Index) + argHighOffset
+		lowValue, highValue := uint32(arg.Value), uint32(arg.Value>>32)
+		switch arg.Op {
+		case OpEqual:
+			prog = append(prog,
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, low),
+				jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, lowValue, 0, 0),
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, high),
+				jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, highValue, 0, 0))
+			failFalse = append(failFalse, len(prog)-3, len(prog)-1)
+		case OpNotEqual:
+			prog = append(prog,
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, low),
+				jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, lowValue, 0, 2),
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, high),
+				jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, highValue, 0, 0))
+			failTrue = append(failTrue, len(prog)-1)
+		case OpMaskedAny:
+			prog = append(prog,
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, low),
+				jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, lowValue, 2, 0),
+				stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, high),
+				jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, highValue, 0, 0))
+			failFalse = append(failFalse, len(prog)-1)
+		}
+	}
+	if len(prog) > 255 {
+		return nil, fmt.Errorf("too many seccomp argument conditions")
+	}
+	// the failure is the instruction after the one following the checks
+	for _, i := range failTrue {
+		prog[i].Jt = uint8(len(prog) - i)
+	}
+	for _, i := range failFalse {
+		prog[i].Jf = uint8(len(prog) - i)
+	}
+	return prog, nil
+}
+
+func action(a Action, errno uint16) uint32 {
+	switch a {
+	case ActErrno:
+		if errno == 0 {
+			errno = uint16(syscall.EPERM)
+		}
+		return retErrno | uint32(errno)
+	case ActKill:
+		return retKillProcess
+	case ActLog:
+		return retLog
+	}
+	return retAllow
+}
+
+func stmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
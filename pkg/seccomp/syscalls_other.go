@@ -0,0 +1,9 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package seccomp
+
+// auditArch is unknown, Compile fails on the architectures without a syscall table
+const auditArch = 0
+
+var syscallNumbers = map[string]uint32{}
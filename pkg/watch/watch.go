@@ -0,0 +1,56 @@
+package watch
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// state identifies a version of a file, which changes when the file
+// is rewritten in place or replaced by a rename.
+type state struct {
+	exists  bool
+	ino     uint64
+	size    int64
+	modTime time.Time
+}
+
+func stat(path string) state {
+	info, err := os.Stat(path)
+	if err != nil {
+		return state{}
+	}
+	st := state{exists: true, size: info.Size(), modTime: info.ModTime()}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		st.ino = sys.Ino
+	}
+	return st
+}
+
+// Files polls the files every interval and calls onChange once per poll
+// in which any of them has been changed, created or removed.
+// It returns when stop is closed.
+func Files(paths []string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	states := make([]state, len(paths))
+	for i, path := range paths {
+		states[i] = stat(path)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed := false
+			for i, path := range paths {
+				if st := stat(path); st != states[i] {
+					states[i], changed = st, true
+				}
+			}
+			if changed {
+				onChange()
+			}
+		}
+	}
+}
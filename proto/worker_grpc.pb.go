@@ -22,6 +22,13 @@ type WorkerClient interface {
 	GetProcessStatus(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Status, error)
 	StreamOutput(ctx context.Context, in *JobId, opts ...grpc.CallOption) (Worker_StreamOutputClient, error)
 	StopProcess(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Empty, error)
+	PauseProcess(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Empty, error)
+	ResumeProcess(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Empty, error)
+	ExecInProcess(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (Worker_ExecInProcessClient, error)
+	UpdateResources(ctx context.Context, in *UpdateResourcesRequest, opts ...grpc.CallOption) (*Empty, error)
+	ListProcesses(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ProcessList, error)
+	ShareProcess(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*Empty, error)
+	SignalProcess(ctx context.Context, in *SignalRequest, opts ...grpc.CallOption) (*Empty, error)
 }
 
 type workerClient struct {
@@ -91,6 +98,92 @@ func (c *workerClient) StopProcess(ctx context.Context, in *JobId, opts ...grpc.
 	return out, nil
 }
 
+func (c *workerClient) PauseProcess(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Worker/PauseProcess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) ResumeProcess(ctx context.Context, in *JobId, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Worker/ResumeProcess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) ExecInProcess(ctx context.Context, in *ExecRequest, opts ...grpc.CallOption) (Worker_ExecInProcessClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Worker_ServiceDesc.Streams[1], "/proto.Worker/ExecInProcess", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workerExecInProcessClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Worker_ExecInProcessClient interface {
+	Recv() (*ExecOutput, error)
+	grpc.ClientStream
+}
+
+type workerExecInProcessClient struct {
+	grpc.ClientStream
+}
+
+func (x *workerExecInProcessClient) Recv() (*ExecOutput, error) {
+	m := new(ExecOutput)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workerClient) UpdateResources(ctx context.Context, in *UpdateResourcesRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Worker/UpdateResources", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) ListProcesses(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ProcessList, error) {
+	out := new(ProcessList)
+	err := c.cc.Invoke(ctx, "/proto.Worker/ListProcesses", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) ShareProcess(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Worker/ShareProcess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) SignalProcess(ctx context.Context, in *SignalRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/proto.Worker/SignalProcess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // WorkerServer is the server API for Worker service.
 // All implementations must embed UnimplementedWorkerServer
 // for forward compatibility
@@ -99,6 +192,13 @@ type WorkerServer interface {
 	GetProcessStatus(context.Context, *JobId) (*Status, error)
 	StreamOutput(*JobId, Worker_StreamOutputServer) error
 	StopProcess(context.Context, *JobId) (*Empty, error)
+	PauseProcess(context.Context, *JobId) (*Empty, error)
+	ResumeProcess(context.Context, *JobId) (*Empty, error)
+	ExecInProcess(*ExecRequest, Worker_ExecInProcessServer) error
+	UpdateResources(context.Context, *UpdateResourcesRequest) (*Empty, error)
+	ListProcesses(context.Context, *ListRequest) (*ProcessList, error)
+	ShareProcess(context.Context, *ShareRequest) (*Empty, error)
+	SignalProcess(context.Context, *SignalRequest) (*Empty, error)
 	mustEmbedUnimplementedWorkerServer()
 }
 
@@ -118,6 +218,27 @@ func (UnimplementedWorkerServer) StreamOutput(*JobId, Worker_StreamOutputServer)
 func (UnimplementedWorkerServer) StopProcess(context.Context, *JobId) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method StopProcess not implemented")
 }
+func (UnimplementedWorkerServer) PauseProcess(context.Context, *JobId) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseProcess not implemented")
+}
+func (UnimplementedWorkerServer) ResumeProcess(context.Context, *JobId) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeProcess not implemented")
+}
+func (UnimplementedWorkerServer) ExecInProcess(*ExecRequest, Worker_ExecInProcessServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExecInProcess not implemented")
+}
+func (UnimplementedWorkerServer) UpdateResources(context.Context, *UpdateResourcesRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateResources not implemented")
+}
+func (UnimplementedWorkerServer) ListProcesses(context.Context, *ListRequest) (*ProcessList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListProcesses not implemented")
+}
+func (UnimplementedWorkerServer) ShareProcess(context.Context, *ShareRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShareProcess not implemented")
+}
+func (UnimplementedWorkerServer) SignalProcess(context.Context, *SignalRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SignalProcess not implemented")
+}
 func (UnimplementedWorkerServer) mustEmbedUnimplementedWorkerServer() {}
 
 // UnsafeWorkerServer may be embedded to opt out of forward compatibility for this service.
@@ -206,6 +327,135 @@ func _Worker_StopProcess_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Worker_PauseProcess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobId)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).PauseProcess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/PauseProcess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).PauseProcess(ctx, req.(*JobId))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_ResumeProcess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobId)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).ResumeProcess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/ResumeProcess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).ResumeProcess(ctx, req.(*JobId))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_ExecInProcess_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExecRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WorkerServer).ExecInProcess(m, &workerExecInProcessServer{stream})
+}
+
+type Worker_ExecInProcessServer interface {
+	Send(*ExecOutput) error
+	grpc.ServerStream
+}
+
+type workerExecInProcessServer struct {
+	grpc.ServerStream
+}
+
+func (x *workerExecInProcessServer) Send(m *ExecOutput) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Worker_UpdateResources_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateResourcesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).UpdateResources(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/UpdateResources",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).UpdateResources(ctx, req.(*UpdateResourcesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_ListProcesses_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).ListProcesses(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/ListProcesses",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).ListProcesses(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_ShareProcess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).ShareProcess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/ShareProcess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).ShareProcess(ctx, req.(*ShareRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_SignalProcess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignalRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).SignalProcess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/SignalProcess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).SignalProcess(ctx, req.(*SignalRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Worker_ServiceDesc is the grpc.ServiceDesc for Worker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -225,6 +475,30 @@ var Worker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "StopProcess",
 			Handler:    _Worker_StopProcess_Handler,
 		},
+		{
+			MethodName: "PauseProcess",
+			Handler:    _Worker_PauseProcess_Handler,
+		},
+		{
+			MethodName: "ResumeProcess",
+			Handler:    _Worker_ResumeProcess_Handler,
+		},
+		{
+			MethodName: "UpdateResources",
+			Handler:    _Worker_UpdateResources_Handler,
+		},
+		{
+			MethodName: "ListProcesses",
+			Handler:    _Worker_ListProcesses_Handler,
+		},
+		{
+			MethodName: "ShareProcess",
+			Handler:    _Worker_ShareProcess_Handler,
+		},
+		{
+			MethodName: "SignalProcess",
+			Handler:    _Worker_SignalProcess_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -232,6 +506,11 @@ var Worker_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Worker_StreamOutput_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "ExecInProcess",
+			Handler:       _Worker_ExecInProcess_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "proto/worker.proto",
 }
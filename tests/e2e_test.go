@@ -1,12 +1,31 @@
 package e2e
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -77,14 +96,8 @@ func TestSyncApp(t *testing.T) {
 	}
 	require.NotEmpty(t, uid, "no uid in stdout[%s]", txt)
 
-	// get process status
-	stdout.Reset()
-	stderr.Reset()
-
-	err = getClnCmd([]string{"status", uid}, &stdout, &stderr, 1).Run()
-	require.NoError(t, err, "status error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
-
-	txt = strings.TrimSpace(string(stdout.Bytes()))
+	// get process status once the process completes
+	txt = waitStatus(t, uid, "StatusStopped", 1)
 	require.Equal(t, txt, "Process status: StatusStopped\nExit status: 0", "unexpected output [%s]", txt)
 
 	// get process output
@@ -163,6 +176,1345 @@ func TestAsyncApp(t *testing.T) {
 	require.Equal(t, txt, "Process status: StatusStopped\nExit status: -1\nSignal: 9", "unexpected output [%s]", txt)
 }
 
+func TestHostNetworkPolicy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// client2 is not allowed to share the host network
+	err := getClnCmd([]string{"-net", "host", "start", "echo", "HelloWorld"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: host network")
+
+	// client1 is
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-net", "host", "start", "echo", "HelloWorld"}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "start error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+}
+
+func TestNetworkModes(t *testing.T) {
+	// the jobs have only loopback by default
+	txt := jobOutput(t, []string{"start", "awk", "-F:", "NR > 2 { gsub(/ /, \"\", $1); print $1 }", "/proc/net/dev"}, 2)
+	require.Equal(t, "lo", txt)
+
+	for _, tool := range []string{"iptables", "ping"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("the bridged network mode test needs %s", tool)
+		}
+	}
+
+	// the bridged jobs get an address and reach the gateway, but not the server API
+	script := "ip -4 -o addr show dev eth0 | awk '{ print $4 }'; " +
+		"ping -c 1 -W 2 10.88.0.1 >/dev/null && echo gateway; " +
+		"timeout 2 bash -c 'echo >/dev/tcp/10.88.0.1/12345' 2>/dev/null && echo api || echo no api"
+	txt = jobOutput(t, []string{"-net", "bridged", "-caps", "NET_RAW", "start", "bash", "-c", script}, 1)
+	require.Regexp(t, `^10\.88\.\d+\.\d+/16\ngateway\nno api$`, txt)
+}
+
+func TestProcIsolation(t *testing.T) {
+	hostInit, err := os.ReadFile("/proc/1/comm")
+	require.NoError(t, err)
+	script := fmt.Sprintf("cat /proc/1/comm; test -d /proc/%d && echo visible || echo hidden", os.Getpid())
+
+	// the job has its own PID 1 and does not see the host processes
+	lines := strings.Split(jobOutput(t, []string{"start", "sh", "-c", script}, 1), "\n")
+	require.Len(t, lines, 2, "output %q", lines)
+	require.NotEqual(t, strings.TrimSpace(string(hostInit)), lines[0])
+	require.Equal(t, "hidden", lines[1])
+
+	// client1 may keep the host /proc view
+	lines = strings.Split(jobOutput(t, []string{"-host-proc", "start", "sh", "-c", script}, 1), "\n")
+	require.Equal(t, []string{strings.TrimSpace(string(hostInit)), "visible"}, lines)
+
+	// client2 may not
+	var stdout, stderr bytes.Buffer
+	err = getClnCmd([]string{"-host-proc", "start", "true"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: host /proc")
+}
+
+func TestUTSIsolation(t *testing.T) {
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	// the job hostname is the first group of the job UUID, or the requested one
+	name := jobOutput(t, []string{"start", "hostname"}, 2)
+	require.NotEqual(t, host, name)
+	require.Len(t, name, 8)
+
+	require.Equal(t, "uts-test", jobOutput(t, []string{"-hostname", "uts-test", "start", "hostname"}, 2))
+
+	// the host hostname is not changed
+	after, err := os.Hostname()
+	require.NoError(t, err)
+	require.Equal(t, host, after)
+}
+
+func TestIPCIsolation(t *testing.T) {
+	// a message queue of the host
+	out, err := exec.Command("ipcmk", "-Q").Output()
+	require.NoError(t, err)
+	qid := strings.TrimSpace(strings.TrimPrefix(string(out), "Message queue id:"))
+	defer exec.Command("ipcrm", "-q", qid).Run()
+
+	// /proc/sysvipc/msg has a header line and a line for each queue of the IPC namespace
+	count := "wc -l < /proc/sysvipc/msg"
+
+	// the jobs do not see the queues of the host nor of each other
+	require.Equal(t, "2", jobOutput(t, []string{"start", "sh", "-c", "ipcmk -Q >/dev/null && " + count}, 2))
+	require.Equal(t, "1", jobOutput(t, []string{"start", "sh", "-c", count}, 2))
+}
+
+func TestJobInit(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// the orphaned processes are reparented to the job init, which reaps them
+	script := "(sleep 0.2 &); sleep 1; grep -l '^State:.*zombie' /proc/[0-9]*/status | wc -l"
+	require.Equal(t, "0", jobOutput(t, []string{"start", "sh", "-c", script}, 2))
+
+	// the signals sent to the job are forwarded to the user command
+	script = "trap 'echo got TERM; exit 3' TERM; echo ready; while true; do sleep 0.1; done"
+	uid := startJob(t, []string{"start", "sh", "-c", script}, 1)
+	// the shell has set the trap once it runs the loop
+	waitFor(t, []string{"exec", uid, "--", "pgrep", "-x", "sleep"}, "", 1)
+
+	err := getClnCmd([]string{"signal", uid, "TERM"}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "signal error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"stream", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stream error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Equal(t, "ready\ngot TERM", strings.TrimSpace(string(stdout.Bytes())))
+}
+
+func TestUserPolicy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// client2 runs jobs as nobody and may not run them as root
+	err := getClnCmd([]string{"-user", "0", "start", "id"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: uid 0")
+
+	// unless root is mapped to its unprivileged range
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-userns", "-user", "0", "start", "id"}, &stdout, &stderr, 2).Run()
+	require.NoError(t, err, "start error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+	// client1 runs jobs as nobody by default, and as root only when requested, as its policy lists uid 0
+	require.Equal(t, "65534 65534", jobOutput(t, []string{"start", "sh", "-c", "echo $(id -u) $(id -g)"}, 1))
+	require.Equal(t, "0", jobOutput(t, []string{"-user", "0", "start", "id", "-u"}, 1))
+}
+
+func TestSeccomp(t *testing.T) {
+	// the default profile kills jobs creating namespaces
+	uid := startJob(t, []string{"start", "unshare", "-m", "true"}, 1)
+	txt := waitStatus(t, uid, "StatusStopped", 1)
+	require.Equal(t, txt, "Process status: StatusStopped\nExit status: -1\nSignal: 31\nKilled by SIGSYS (likely seccomp)", "unexpected output [%s]", txt)
+
+	// including with clone, while clone3 is not implemented
+	cloneNr, clone3Nr := map[string]int{"amd64": 56, "arm64": 220}[runtime.GOARCH], 435
+	for _, args := range [][]string{
+		{"unshare", "-U", "true"},
+		{"perl", "-e", fmt.Sprintf("syscall(%d, 0x10000011, 0, 0, 0, 0)", cloneNr)},
+	} {
+		uid = startJob(t, append([]string{"start"}, args...), 1)
+		txt = waitStatus(t, uid, "StatusStopped", 1)
+		require.Contains(t, txt, "Killed by SIGSYS (likely seccomp)", "%v: unexpected output [%s]", args, txt)
+	}
+	txt = jobOutput(t, []string{"start", "perl", "-e", fmt.Sprintf(`syscall(%d, 0, 0); print "$!\n"`, clone3Nr)}, 1)
+	require.Equal(t, "Function not implemented", txt)
+
+	// the threads are still created
+	txt = jobOutput(t, []string{"start", "/usr/bin/python3", "-c", "import threading; t = threading.Thread(target=print, args=('thread',)); t.start(); t.join()"}, 1)
+	require.Equal(t, "thread", txt)
+
+	// client2 may not run unconfined jobs
+	var stdout, stderr bytes.Buffer
+	err := getClnCmd([]string{"-seccomp", "unconfined", "start", "true"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: seccomp profile")
+}
+
+func TestCapabilities(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// client2 may not add CAP_SYS_ADMIN
+	err := getClnCmd([]string{"-caps", "SYS_ADMIN", "start", "true"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: capability CAP_SYS_ADMIN")
+
+	// client1 may add CAP_NET_RAW, which a job running as nobody keeps
+	txt := jobOutput(t, []string{"-user", "65534", "-caps", "NET_RAW", "start", "grep", "-E", "^(CapEff|NoNewPrivs)", "/proc/self/status"}, 1)
+	require.Equal(t, txt, "CapEff:\t0000000000002000\nNoNewPrivs:\t1")
+}
+
+func TestRlimits(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// the server caps the core size
+	err := getClnCmd([]string{"-rlimit", "core=8G", "start", "true"}, &stdout, &stderr, 1).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "limit exceeded: rlimit core")
+
+	txt := jobOutput(t, []string{"-rlimit", "nofile=100", "start", "sh", "-c", "ulimit -n"}, 1)
+	require.Equal(t, txt, "100")
+}
+
+func TestCPULimits(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// the quota may not exceed the host CPUs
+	err := getClnCmd([]string{"-cpus", "100000", "start", "true"}, &stdout, &stderr, 1).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "limit exceeded: CPU quota")
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-cpus", "0.5", "-cpuset", "0", "start", "true"}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "start error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+	// huge CPU and memory node ranges are rejected before they are expanded
+	for _, args := range [][]string{{"-cpuset", "0-2000000000"}, {"-cpuset-mems", "0-2000000000"}} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd(append(args, "start", "true"), &stdout, &stderr, 1).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), "code = InvalidArgument")
+	}
+}
+
+func TestExclusiveCPUs(t *testing.T) {
+	if runtime.NumCPU() < 2 {
+		t.Skip("the exclusive CPUs need a CPU left to the other jobs")
+	}
+	var stdout, stderr bytes.Buffer
+
+	// the server reserves the last CPU for the jobs requesting exclusive CPUs
+	reserved := runtime.NumCPU() - 1
+	startServer(t, "", 12346, "-exclusive-cpus", strconv.Itoa(reserved))
+	addr := []string{"-addr", "localhost:12346"}
+	cpus := func(uid string) string {
+		return waitFor(t, append(addr, "exec", uid, "--", "grep", "Cpus_allowed_list", "/proc/self/status"), "Cpus_allowed_list", 1)
+	}
+
+	// the job requesting an exclusive CPU gets it
+	uid := startJob(t, append(addr, "-exclusive-cpus", "1", "start", "sleep", "1000"), 1)
+	defer getClnCmd(append(addr, "stop", uid), &stdout, &stderr, 1).Run()
+	require.Equal(t, fmt.Sprintf("Cpus_allowed_list:\t%d", reserved), cpus(uid))
+
+	// the other jobs do not
+	shared := startJob(t, append(addr, "start", "sleep", "1000"), 1)
+	defer getClnCmd(append(addr, "stop", shared), &stdout, &stderr, 1).Run()
+	require.NotContains(t, strings.Split(strings.TrimPrefix(cpus(shared), "Cpus_allowed_list:\t"), ","), strconv.Itoa(reserved))
+
+	for _, tc := range []struct {
+		args   []string
+		output string
+	}{
+		// the pool is exhausted
+		{[]string{"-exclusive-cpus", "1"}, "code = ResourceExhausted"},
+		// and no job may pin itself to the reserved CPUs
+		{[]string{"-exclusive-cpus", "1", "-cpuset", "0"}, "code = InvalidArgument"},
+		{[]string{"-cpuset", strconv.Itoa(reserved)}, "code = PermissionDenied"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd(append(append(addr, tc.args...), "start", "true"), &stdout, &stderr, 1).Run()
+		require.Error(t, err, "%v: stdout[%s] stderr[%s]", tc.args, string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output, "%v", tc.args)
+	}
+
+	// the CPU returns to the pool once the job exits
+	stdout.Reset()
+	stderr.Reset()
+	err := getClnCmd(append(addr, "stop", uid), &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stop error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	waitFor(t, append(addr, "status", uid), "Process status: StatusStopped", 1)
+	uid = startJob(t, append(addr, "-exclusive-cpus", "1", "start", "grep", "Cpus_allowed_list", "/proc/self/status"), 1)
+	require.Equal(t, fmt.Sprintf("Cpus_allowed_list:\t%d", reserved), waitFor(t, append(addr, "stream", uid), "Cpus_allowed_list", 1))
+}
+
+func TestPauseResume(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, []string{"start", "scripts/loop.sh"}, 1)
+	waitJobInit(t, uid)
+
+	// client2 may not pause jobs
+	err := getClnCmd([]string{"pause", uid}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+
+	for _, step := range []struct {
+		cmd    string
+		status string
+	}{
+		{"pause", "StatusPaused"},
+		{"resume", "StatusRunning"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd([]string{step.cmd, uid}, &stdout, &stderr, 1).Run()
+		require.NoError(t, err, "%s error[%v] stdout[%s] stderr[%s]", step.cmd, err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd([]string{"status", uid}, &stdout, &stderr, 1).Run()
+		require.NoError(t, err, "status error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+		txt := strings.TrimSpace(string(stdout.Bytes()))
+		require.Equal(t, txt, "Process status: "+step.status, "unexpected output [%s]", txt)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"stop", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stop error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+}
+
+func TestExec(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, []string{"-hostname", "exec-test", "start", "scripts/loop.sh"}, 1)
+	waitJobInit(t, uid)
+
+	// client2 may not exec in jobs
+	err := getClnCmd([]string{"exec", uid, "--", "hostname"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+
+	// the command runs in the job namespaces and returns its exit status
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"exec", uid, "--", "sh", "-c", "hostname; exit 5"}, &stdout, &stderr, 1).Run()
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Equal(t, 5, exitErr.ExitCode())
+
+	txt := strings.TrimSpace(string(stdout.Bytes()))
+	require.Equal(t, "exec-test", txt, "unexpected output [%s]", txt)
+
+	// the command is killed once its client is gone, even if it writes nothing
+	stdout.Reset()
+	stderr.Reset()
+
+	cmd := getClnCmd([]string{"exec", uid, "--", "sleep", "1000"}, &stdout, &stderr, 1)
+	require.NoError(t, cmd.Start())
+	check := "pgrep -f '^sleep 1000' >/dev/null && echo running || echo gone"
+	waitFor(t, []string{"exec", uid, "--", "sh", "-c", check}, "running", 1)
+	require.NoError(t, cmd.Process.Kill())
+	cmd.Wait()
+	waitFor(t, []string{"exec", uid, "--", "sh", "-c", check}, "gone", 1)
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"stop", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stop error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+}
+
+func TestUpdateResources(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, []string{"start", "scripts/loop.sh"}, 1)
+	waitJobInit(t, uid)
+
+	// the limits may not exceed the client ceilings
+	err := getClnCmd([]string{"-memory", "2G", "update", uid}, &stdout, &stderr, 1).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "limit exceeded: memory")
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-memory", "32M", "update", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "update error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+
+	// the change is recorded in the job history
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-history", "status", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "status error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "client1: resources updated: memory 10485760 -> 33554432 bytes")
+
+	// several limits are updated at once
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"-cpu-shares", "1024", "-cpus", "0.5", "update", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "update error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	txt := waitFor(t, []string{"-history", "status", uid}, "client1: resources updated: CPU shares", 1)
+	require.Contains(t, txt, "client1: resources updated: CPU shares 512 -> 1024, CPU quota unlimited -> 0.5 CPUs")
+
+	stdout.Reset()
+	stderr.Reset()
+
+	err = getClnCmd([]string{"stop", uid}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stop error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+}
+
+func TestRootfsImages(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// a symbolic link in the image directory may not lead to a host directory
+	imageDir := "/var/lib/gravitest/images"
+	require.NoError(t, os.MkdirAll(imageDir, 0755))
+	escape := filepath.Join(imageDir, "e2e-escape")
+	os.Remove(escape)
+	require.NoError(t, os.Symlink("/", escape))
+	defer os.Remove(escape)
+
+	for _, tc := range []struct {
+		rootfs string
+		output string
+	}{
+		{"/", "invalid image name"},
+		{"../../../..", "invalid image name"},
+		{"e2e-escape", "outside of the image directory"},
+		{"no-such-image", "no image"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd([]string{"-rootfs", tc.rootfs, "start", "true"}, &stdout, &stderr, 1).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), "code = InvalidArgument")
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+
+	// the images are made of the host shell, the checks below use its builtins only
+	base := shellFiles(t)
+	check := `read image </etc/image; echo $image; for f in /etc/removed /opt/dir/* /escaped; do [ -e $f ] && echo $f; done`
+
+	// a directory is used as is
+	dir := filepath.Join(imageDir, "e2e-dir")
+	defer os.RemoveAll(dir)
+	for _, entry := range append(base, tarEntry{name: "etc/image", body: []byte("directory\n")}) {
+		path := filepath.Join(dir, entry.name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, entry.body, 0755))
+	}
+	require.Equal(t, "directory", jobOutput(t, []string{"-rootfs", "e2e-dir", "start", "/bin/sh", "-c", check}, 1))
+
+	// a tarball is extracted into the image, including the entries leading out of it
+	tarball := filepath.Join(imageDir, "e2e-tar.tar.gz")
+	defer os.Remove(tarball)
+	writeTar(t, tarball, true, append(base,
+		tarEntry{name: "etc/image", body: []byte("tarball\n")},
+		tarEntry{name: "../escaped", body: []byte("escaped\n")},
+	))
+	require.Equal(t, "tarball\n/escaped", jobOutput(t, []string{"-rootfs", "e2e-tar.tar.gz", "start", "/bin/sh", "-c", check}, 1))
+	require.NoFileExists(t, "/var/lib/gravitest/layers/escaped")
+
+	// but not through the symbolic links of the image
+	symlink := filepath.Join(imageDir, "e2e-symlink.tar")
+	defer os.Remove(symlink)
+	writeTar(t, symlink, false, append(base,
+		tarEntry{name: "etc/host", linkname: "/etc"},
+		tarEntry{name: "etc/host/e2e-escaped", body: []byte("escaped\n")},
+	))
+	stdout.Reset()
+	stderr.Reset()
+	err := getClnCmd([]string{"-rootfs", "e2e-symlink.tar", "start", "true"}, &stdout, &stderr, 1).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "below a symbolic link")
+	require.NoFileExists(t, "/etc/e2e-escaped")
+
+	// the OCI image layers are stacked, the upper layer whiteouts hiding the lower layer entries
+	layout := filepath.Join(imageDir, "e2e-oci")
+	defer os.RemoveAll(layout)
+	writeOCILayout(t, layout, "latest",
+		append(base,
+			tarEntry{name: "etc/image", body: []byte("base\n")},
+			tarEntry{name: "etc/removed", body: []byte("removed\n")},
+			tarEntry{name: "opt/dir/old", body: []byte("old\n")},
+		),
+		[]tarEntry{
+			{name: "etc/image", body: []byte("oci\n")},
+			{name: "etc/.wh.removed"},
+			{name: "opt/dir/.wh..wh..opq"},
+			{name: "opt/dir/new", body: []byte("new\n")},
+		},
+	)
+	require.Equal(t, "oci\n/opt/dir/new", jobOutput(t, []string{"-rootfs", "e2e-oci:latest", "start", "/bin/sh", "-c", check}, 1))
+}
+
+// shellFiles returns the host shell and the libraries it loads as image entries,
+// in a stable order so the image layers keep their digests.
+func shellFiles(t *testing.T) []tarEntry {
+	out, err := exec.Command("ldd", "/bin/sh").Output()
+	require.NoError(t, err)
+	var files []tarEntry
+	paths := []string{"/bin/sh"}
+	for _, field := range strings.Fields(string(out)) {
+		if strings.HasPrefix(field, "/") {
+			paths = append(paths, field)
+		}
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		files = append(files, tarEntry{name: strings.TrimPrefix(path, "/"), body: data})
+	}
+	return files
+}
+
+// tarEntry is a regular file, or a symbolic link if linkname is set
+type tarEntry struct {
+	name     string
+	body     []byte
+	linkname string
+}
+
+func writeTar(t *testing.T, path string, compress bool, entries []tarEntry) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, writeTarStream(f, compress, entries))
+}
+
+func writeTarStream(w io.Writer, compress bool, entries []tarEntry) error {
+	if compress {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: 0755, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}
+		if len(entry.linkname) != 0 {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, entry.linkname, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.body); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeOCILayout writes an OCI image layout with the tagged image of the layers, base layer first.
+func writeOCILayout(t *testing.T, layout, tag string, layers ...[]tarEntry) {
+	blobs := filepath.Join(layout, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobs, 0755))
+	writeBlob := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		require.NoError(t, os.WriteFile(filepath.Join(blobs, fmt.Sprintf("%x", sum)), data, 0644))
+		return fmt.Sprintf("sha256:%x", sum)
+	}
+
+	type descriptor struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int               `json:"size"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	config := []byte("{}")
+	manifest := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{2, "application/vnd.oci.image.manifest.v1+json", descriptor{"application/vnd.oci.image.config.v1+json", writeBlob(config), len(config), nil}, nil}
+	for _, layer := range layers {
+		var buf bytes.Buffer
+		require.NoError(t, writeTarStream(&buf, true, layer))
+		manifest.Layers = append(manifest.Layers, descriptor{"application/vnd.oci.image.layer.v1.tar+gzip", writeBlob(buf.Bytes()), buf.Len(), nil})
+	}
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	index := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		Manifests     []descriptor `json:"manifests"`
+	}{2, []descriptor{{"application/vnd.oci.image.manifest.v1+json", writeBlob(data), len(data), map[string]string{"org.opencontainers.image.ref.name": tag}}}}
+	data, err = json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "index.json"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644))
+}
+
+func TestMounts(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// a host directory of client1 and a symbolic link leading out of its allowed paths
+	dir, err := os.MkdirTemp("/tmp", "e2e-mounts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("host file\n"), 0644))
+	require.NoError(t, os.Symlink("/etc", filepath.Join(dir, "escape")))
+
+	for _, tc := range []struct {
+		args    []string
+		clientN int
+		output  string
+	}{
+		// the policy lists the host paths the client may mount
+		{[]string{"-mount", "/etc:/mnt:ro"}, 2, "permission denied: mount /etc"},
+		{[]string{"-mount", filepath.Join(dir, "escape") + ":/mnt:ro"}, 1, "permission denied: mount " + filepath.Join(dir, "escape")},
+		// and whether they may be mounted read-write
+		{[]string{"-mount", "/usr/share:/mnt"}, 2, "permission denied: read-write mount /usr/share"},
+		// the tmpfs mounts of a job may not exceed the client total
+		{[]string{"-tmpfs", "/mnt:32M", "-tmpfs", "/media:64M"}, 2, "permission denied: tmpfs size exceeds 67108864 bytes"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd(append(tc.args, "start", "true"), &stdout, &stderr, tc.clientN).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+
+	// a read-only mount may not be written, even by root
+	write := "cat /mnt/file; touch /mnt/new 2>/dev/null && echo written || echo read-only"
+	require.Equal(t, "host file\nread-only", jobOutput(t, []string{"-user", "0", "-mount", dir + ":/mnt:ro", "start", "sh", "-c", write}, 1))
+	require.NoFileExists(t, filepath.Join(dir, "new"))
+	require.Equal(t, "host file\nwritten", jobOutput(t, []string{"-user", "0", "-mount", dir + ":/mnt", "start", "sh", "-c", write}, 1))
+	require.FileExists(t, filepath.Join(dir, "new"))
+
+	// a tmpfs is limited to its size
+	fill := "(head -c 2097152 /dev/zero >/mnt/fill) 2>/dev/null && echo fits || echo full; du -k /mnt/fill | cut -f1"
+	require.Equal(t, "full\n1024", jobOutput(t, []string{"-tmpfs", "/mnt:1M", "start", "sh", "-c", fill}, 2))
+}
+
+func TestDevices(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// client2 may not use /dev/full
+	err := getClnCmd([]string{"-device", "/dev/full", "start", "true"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied: device /dev/full")
+
+	// the resolved device path may not contain the ':' separator of the runner arguments
+	dir, err := os.MkdirTemp("/tmp", "e2e-devices")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a:b"), nil, 0644))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a:b"), filepath.Join(dir, "link")))
+	stdout.Reset()
+	stderr.Reset()
+	err = getClnCmd([]string{"-device", filepath.Join(dir, "link"), "start", "true"}, &stdout, &stderr, 1).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "code = InvalidArgument")
+	require.Contains(t, string(stdout.Bytes()), "contains ':'")
+
+	for _, tc := range []struct {
+		args   []string
+		output string
+	}{
+		{[]string{"start"}, "null ok\nfull denied"},
+		{[]string{"-device", "/dev/full:r", "start"}, "null ok\nfull ok"},
+	} {
+		args := append(tc.args, "sh", "-c", "for d in null full; do head -c1 /dev/$d >/dev/null 2>&1 && echo $d ok || echo $d denied; done")
+		txt := jobOutput(t, args, 1)
+		require.Equal(t, tc.output, txt, "unexpected output [%s]", txt)
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	policyPath := filepath.Join(workDir, "config", "policy.yaml")
+	policy, err := os.ReadFile(policyPath)
+	require.NoError(t, err)
+	defer os.WriteFile(policyPath, policy, 0644)
+
+	// client2 may not get the job status
+	err = getClnCmd([]string{"status", "no-such-job"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied")
+
+	for _, tc := range []struct {
+		policy string
+		output string
+	}{
+		// the server picks up the granted permission
+		{strings.Replace(string(policy), "permissions: [start, stop, stream]", "permissions: [start, stop, stream, status]", 1), "process not found"},
+		// and keeps it when the new policy is invalid
+		{strings.Replace(string(policy), "permissions: [start, stop, stream]", "permissions: [start, unknown]", 1), "process not found"},
+		{string(policy), "permission denied"},
+	} {
+		require.NoError(t, os.WriteFile(policyPath, []byte(tc.policy), 0644))
+		time.Sleep(3 * time.Second)
+
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd([]string{"status", "no-such-job"}, &stdout, &stderr, 2).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	policyPath := filepath.Join(workDir, "config", "policy.yaml")
+	policy, err := os.ReadFile(policyPath)
+	require.NoError(t, err)
+	defer os.WriteFile(policyPath, policy, 0644)
+
+	// client2 joins the auditors group with the viewer role
+	require.NoError(t, os.WriteFile(policyPath, []byte(strings.Replace(string(policy), "members: []", "members: [client2]", 1)), 0644))
+	time.Sleep(3 * time.Second)
+
+	for _, tc := range []struct {
+		args   []string
+		output string
+	}{
+		{[]string{"status", "no-such-job"}, "process not found"},
+		{[]string{"pause", "no-such-job"}, "permission denied"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd(tc.args, &stdout, &stderr, 2).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+func TestCrossTenant(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// client2 starts a job, client1 is an admin
+	uid := startJob(t, []string{"start", "scripts/loop.sh"}, 2)
+
+	for _, tc := range []struct {
+		args   []string
+		output string
+		fail   bool
+	}{
+		// the jobs of other clients are only listed on request
+		{[]string{"list"}, "", false},
+		{[]string{"-all", "list"}, uid + " client2 StatusRunning", false},
+		{[]string{"-history", "status", uid}, "Owner: client2", false},
+		// the admin may not act on the job as its owner
+		{[]string{"pause", uid}, "process not found", true},
+		{[]string{"stop", uid}, "Done", false},
+		{[]string{"-history", "status", uid}, "client1: stop requested by a cross-tenant client", false},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd(tc.args, &stdout, &stderr, 1).Run()
+		if tc.fail {
+			require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		} else {
+			require.NoError(t, err, "%v error[%v] stdout[%s] stderr[%s]", tc.args, err, string(stdout.Bytes()), string(stderr.Bytes()))
+		}
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+		if tc.args[0] == "list" {
+			require.NotContains(t, string(stdout.Bytes()), uid)
+		}
+	}
+
+	// other clients may not list all the jobs
+	stdout.Reset()
+	stderr.Reset()
+
+	err := getClnCmd([]string{"-all", "list"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), "permission denied")
+}
+
+func TestShare(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, []string{"start", "scripts/loop.sh"}, 1)
+
+	for _, tc := range []struct {
+		args    []string
+		clientN int
+		output  string
+		fail    bool
+	}{
+		{[]string{"stop", uid}, 2, "process not found", true},
+		// the read access does not allow stopping the job
+		{[]string{"share", uid, "client2"}, 1, "Done", false},
+		{[]string{"stop", uid}, 2, "process not found", true},
+		{[]string{"-control", "share", uid, "client2", "group:auditors"}, 1, "Done", false},
+		{[]string{"-history", "status", uid}, 1, "Shared with client2: ShareControl\nShared with group auditors: ShareControl", false},
+		{[]string{"signal", uid, "STOP"}, 2, "Done", false},
+		{[]string{"signal", uid, "CONT"}, 2, "Done", false},
+		// the revoked grants are removed
+		{[]string{"-revoke", "share", uid, "client2", "group:auditors"}, 1, "Done", false},
+		{[]string{"signal", uid, "CONT"}, 2, "process not found", true},
+		{[]string{"-history", "status", uid}, 1, "client1: revoked the access of client2", false},
+		{[]string{"stop", uid}, 1, "Done", false},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd(tc.args, &stdout, &stderr, tc.clientN).Run()
+		if tc.fail {
+			require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		} else {
+			require.NoError(t, err, "%v error[%v] stdout[%s] stderr[%s]", tc.args, err, string(stdout.Bytes()), string(stderr.Bytes()))
+		}
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	denylistPath := filepath.Join(workDir, "config", "denylist")
+	denylist, err := os.ReadFile(denylistPath)
+	require.NoError(t, err)
+	defer func() {
+		os.WriteFile(denylistPath, denylist, 0644)
+		time.Sleep(3 * time.Second)
+	}()
+
+	data, err := os.ReadFile(filepath.Join(workDir, "certs", "client2.crt"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	for _, tc := range []struct {
+		entry  string
+		denied bool
+	}{
+		{"sha256 Fingerprint=" + strings.ReplaceAll(fmt.Sprintf("% X", fingerprint[:]), " ", ":"), true},
+		{"serial=" + cert.SerialNumber.Text(16) + " issuer=" + cert.Issuer.String(), true},
+		// the serial numbers are only unique per issuer
+		{"serial=" + cert.SerialNumber.Text(16) + " issuer=CN=OtherCA", false},
+	} {
+		require.NoError(t, os.WriteFile(denylistPath, []byte(string(denylist)+tc.entry+"\n"), 0644))
+		time.Sleep(3 * time.Second)
+
+		// client2 is rejected if denied, client1 is not
+		outputs := map[int]string{1: "process not found", 2: "process not found"}
+		if tc.denied {
+			outputs[2] = "code = Unavailable"
+		}
+		for clientN, output := range outputs {
+			stdout.Reset()
+			stderr.Reset()
+
+			err = getClnCmd([]string{"stop", "no-such-job"}, &stdout, &stderr, clientN).Run()
+			require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+			require.Contains(t, string(stdout.Bytes()), output)
+		}
+	}
+}
+
+func TestCRL(t *testing.T) {
+	// the server checks the client certificates against the CRL of the test CA
+	ca, caKey := loadTestCA(t)
+	dir := serverDir(t)
+	crlPath := filepath.Join(dir, "ca.crl")
+	writeCRL(t, crlPath, ca, caKey)
+	startServer(t, dir, 12347, "-crl", crlPath)
+
+	revokedCrt, revokedKey := newClientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}})
+	keptCrt, keptKey := newClientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}})
+	checkClientCert(t, 12347, revokedCrt, revokedKey, "process not found")
+
+	// the server refuses the certificates revoked by the updated CRL
+	writeCRL(t, crlPath, ca, caKey, parseCert(t, revokedCrt).SerialNumber)
+	time.Sleep(3 * time.Second)
+	checkClientCert(t, 12347, revokedCrt, revokedKey, "code = Unavailable")
+	checkClientCert(t, 12347, keptCrt, keptKey, "process not found")
+
+	// the test CA may still revoke its certificates during its grace period, once it is rotated
+	ca2, _ := newCA(t, "RootCA2")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "certs", "ca.crt"), certPEM(ca2), 0644))
+	time.Sleep(3 * time.Second)
+	checkClientCert(t, 12347, keptCrt, keptKey, "process not found")
+	writeCRL(t, crlPath, ca, caKey, parseCert(t, revokedCrt).SerialNumber, parseCert(t, keptCrt).SerialNumber)
+	time.Sleep(3 * time.Second)
+	checkClientCert(t, 12347, revokedCrt, revokedKey, "code = Unavailable")
+	checkClientCert(t, 12347, keptCrt, keptKey, "code = Unavailable")
+}
+
+func TestCARotation(t *testing.T) {
+	dir := serverDir(t)
+	startServer(t, dir, 12348, "-ca-grace", "6s")
+
+	serverCert := func() *x509.Certificate {
+		certificate, err := tls.LoadX509KeyPair(filepath.Join(workDir, "certs", "client1.crt"), filepath.Join(workDir, "certs", "client1.key"))
+		require.NoError(t, err)
+		pool := x509.NewCertPool()
+		pool.AddCert(parseCert(t, filepath.Join(workDir, "certs", "ca.crt")))
+		conn, err := tls.Dial("tcp", "localhost:12348", &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{certificate}})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	// the server serves its new certificate to the new connections without a restart
+	ca, caKey := loadTestCA(t)
+	crt, key := signCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	serial := parseCert(t, crt).SerialNumber
+	require.NotEqual(t, serial, serverCert().SerialNumber)
+	for src, dst := range map[string]string{key: "server.key", crt: "server.crt"} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "certs", dst), data, 0600))
+	}
+	time.Sleep(3 * time.Second)
+	require.Equal(t, serial, serverCert().SerialNumber)
+
+	oldCrt, oldKey := newClientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}})
+	checkClientCert(t, 12348, oldCrt, oldKey, "process not found")
+
+	// a new CA signs a client1 certificate, which the server accepts once the CA is added to the bundle
+	ca2, ca2Key := newCA(t, "RootCA2")
+	newCrt, newKey := signClientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}}, ca2, ca2Key)
+	checkClientCert(t, 12348, newCrt, newKey, "code = Unavailable")
+
+	caPath := filepath.Join(dir, "certs", "ca.crt")
+	require.NoError(t, os.WriteFile(caPath, certPEM(ca, ca2), 0644))
+	time.Sleep(3 * time.Second)
+	checkClientCert(t, 12348, newCrt, newKey, "process not found")
+
+	// the certificates of the CA removed from the bundle are only accepted for the grace period
+	require.NoError(t, os.WriteFile(caPath, certPEM(ca2), 0644))
+	time.Sleep(3 * time.Second)
+	checkClientCert(t, 12348, oldCrt, oldKey, "process not found")
+	checkClientCert(t, 12348, newCrt, newKey, "process not found")
+
+	time.Sleep(7 * time.Second)
+	checkClientCert(t, 12348, oldCrt, oldKey, "code = Unavailable")
+	checkClientCert(t, 12348, newCrt, newKey, "process not found")
+}
+
+func TestIdentity(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// the server identifies the clients by CN
+	spiffeID, err := url.Parse("spiffe://corp/ns/ci/sa/builder")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		template *x509.Certificate
+		output   string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "client1"}, URIs: []*url.URL{spiffeID}}, "process not found"},
+		{&x509.Certificate{URIs: []*url.URL{spiffeID}}, "code = Unavailable"},
+	} {
+		crt, key := newClientCert(t, tc.template)
+
+		stdout.Reset()
+		stderr.Reset()
+
+		cmd := getClnCmd([]string{"stop", "no-such-job"}, &stdout, &stderr, 1)
+		cmd.Env = append(os.Environ(), "CA_CERT=./certs/ca.crt", "CLIENT_CERT="+crt, "CLIENT_KEY="+key)
+		err = cmd.Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+
+	// the servers identifying the clients by SPIFFE ID or DNS SAN only accept the IDs of their trust domains
+	policyPath := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "clients:\n  spiffe://corp/ns/ci/sa/builder:\n    permissions: [stop]\n  builder.ci.corp:\n    permissions: [stop]\n"
+	require.NoError(t, os.WriteFile(policyPath, []byte(policy), 0644))
+	startServer(t, "", 12349, "-policy", policyPath, "-identity", "uri", "-trust-domains", "corp")
+	startServer(t, "", 12350, "-policy", policyPath, "-identity", "dns", "-trust-domains", "corp")
+
+	uris := func(uri string) []*url.URL {
+		id, err := url.Parse(uri)
+		require.NoError(t, err)
+		return []*url.URL{id}
+	}
+	for _, tc := range []struct {
+		port     int
+		template *x509.Certificate
+		output   string
+	}{
+		{12349, &x509.Certificate{URIs: uris("spiffe://corp/ns/ci/sa/builder")}, "process not found"},
+		// the client ID is the SPIFFE ID, not the CN
+		{12349, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}, URIs: uris("spiffe://corp/ns/ci/sa/deployer")}, "code = PermissionDenied"},
+		{12349, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}, URIs: uris("spiffe://other/ns/ci/sa/builder")}, "code = Unavailable"},
+		{12350, &x509.Certificate{DNSNames: []string{"builder.ci.corp"}}, "process not found"},
+		{12350, &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}, DNSNames: []string{"builder.ci.other"}}, "code = Unavailable"},
+	} {
+		crt, key := newClientCert(t, tc.template)
+		checkClientCert(t, tc.port, crt, key, tc.output)
+	}
+}
+
+// newClientCert creates a client certificate and key signed by the test CA and returns their paths.
+func newClientCert(t *testing.T, template *x509.Certificate) (string, string) {
+	ca, caKey := loadTestCA(t)
+	return signClientCert(t, template, ca, caKey)
+}
+
+// signClientCert creates a client certificate and key signed by the CA and returns their paths.
+func signClientCert(t *testing.T, template *x509.Certificate, ca *x509.Certificate, caKey crypto.Signer) (string, string) {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return signCert(t, template, ca, caKey)
+}
+
+// signCert creates a certificate and key of the template signed by the CA and returns their paths.
+func signCert(t *testing.T, template *x509.Certificate, ca *x509.Certificate, caKey crypto.Signer) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	crtPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return crtPath, keyPath
+}
+
+func TestAuditLog(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, []string{"start", "true"}, 1)
+
+	// a denied call, a call on the job of another client and a cross-tenant listing
+	err := getClnCmd([]string{"status", "audit-job"}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	err = getClnCmd([]string{"stop", uid}, &stdout, &stderr, 2).Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	err = getClnCmd([]string{"-all", "list"}, &stdout, &stderr, 1).Run()
+	require.NoError(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+
+	auditPath := "/var/log/gravitest/audit.log"
+	data, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.GreaterOrEqual(t, len(lines), 3)
+
+	records := []map[string]interface{}{}
+	for _, line := range lines[len(lines)-3:] {
+		record := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	require.Equal(t, "client2", records[0]["clientId"])
+	require.Equal(t, "GetProcessStatus", records[0]["rpc"])
+	require.Equal(t, "audit-job", records[0]["job"])
+	require.Equal(t, false, records[0]["allowed"])
+	require.Contains(t, records[0]["peer"], "127.0.0.1:")
+	// the job of another client is reported as not found, and recorded as denied
+	require.Equal(t, "StopProcess", records[1]["rpc"])
+	require.Equal(t, false, records[1]["allowed"])
+	require.Equal(t, "process not found", records[1]["error"])
+	// a cross-tenant call is a single record
+	require.Equal(t, "ListProcesses", records[2]["rpc"])
+	require.Equal(t, true, records[2]["allowed"])
+	require.Equal(t, true, records[2]["crossTenant"])
+
+	keyPath := filepath.Join(t.TempDir(), "audit.key")
+	require.NoError(t, os.WriteFile(keyPath, bytes.Repeat([]byte("k"), 32), 0600))
+
+	for _, tc := range []struct {
+		data   string
+		args   []string
+		output string
+	}{
+		{string(data), nil, "valid"},
+		// a modified record breaks the chain
+		{strings.Replace(string(data), `"clientId":"client2","peer"`, `"clientId":"client1","peer"`, 1), nil, "has been modified"},
+		{strings.Join(append(lines[:len(lines)-3], lines[len(lines)-2:]...), "\n"), nil, "follows record"},
+		// the records of a log without a key do not match the HMAC of a key
+		{string(data), []string{"-audit-key", keyPath}, "has been modified"},
+	} {
+		logPath := filepath.Join(t.TempDir(), "audit.log")
+		require.NoError(t, os.WriteFile(logPath, []byte(tc.data), 0600))
+
+		stdout.Reset()
+		stderr.Reset()
+
+		cmd := exec.Command("./server", append(tc.args, "verify-audit", logPath)...)
+		cmd.Dir, cmd.Stdout, cmd.Stderr = workDir, &stdout, &stderr
+		err = cmd.Run()
+		if tc.output == "valid" {
+			require.NoError(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		} else {
+			require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		}
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	for _, tc := range []struct {
+		args    []string
+		clientN int
+		output  string
+	}{
+		{[]string{"status", "no-such-job"}, 2, "code = PermissionDenied desc = permission denied"},
+		{[]string{"status", "no-such-job"}, 1, "code = NotFound desc = process not found"},
+		{[]string{"-hostname", "bad host", "start", "true"}, 1, "code = InvalidArgument"},
+		{[]string{"-cpus", "100000", "start", "true"}, 1, "code = ResourceExhausted"},
+		// the streaming calls are authorized by the interceptors as well
+		{[]string{"exec", "no-such-job", "--", "true"}, 2, "code = PermissionDenied"},
+		{[]string{"stream", "no-such-job"}, 1, "code = NotFound"},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd(tc.args, &stdout, &stderr, tc.clientN).Run()
+		require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+func TestExecutables(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	policyPath := filepath.Join(workDir, "config", "policy.yaml")
+	policy, err := os.ReadFile(policyPath)
+	require.NoError(t, err)
+	defer os.WriteFile(policyPath, policy, 0644)
+
+	// client2 may only echo lower case words, and run true as a member of a restricted group;
+	// the group does not restrict client1, an admin
+	rules := "    maxCpus: 1\n    executables:\n      - {path: /bin/echo, args: ['[a-z]+']}\n      - {path: /usr/bin/echo, args: ['[a-z]+']}\n"
+	group := "roles:\n  truer:\n    permissions: [start]\n    executables:\n      - {path: /bin/true}\n      - {path: /usr/bin/true}\n" +
+		"groups:\n  - name: truers\n    roles: [truer]\n    members: [client1, client2]\n"
+	restricted := strings.Replace(strings.Replace(string(policy), "    maxCpus: 1\n", rules, 1), "groups:\n", group, 1)
+	require.NoError(t, os.WriteFile(policyPath, []byte(restricted), 0644))
+	time.Sleep(3 * time.Second)
+
+	for _, tc := range []struct {
+		args    []string
+		clientN int
+		output  string
+		fail    bool
+	}{
+		{[]string{"start", "echo", "hello"}, 2, "Process UID:", false},
+		{[]string{"start", "true"}, 2, "Process UID:", false},
+		{[]string{"start", "echo", "hello", "World"}, 2, `/echo are not allowed by the executable rules: "World"`, true},
+		{[]string{"start", "scripts/loop.sh"}, 2, "scripts/loop.sh is not allowed by the executable rules", true},
+		{[]string{"start", "echo", "hello", "World"}, 1, "Process UID:", false},
+	} {
+		stdout.Reset()
+		stderr.Reset()
+
+		err = getClnCmd(tc.args, &stdout, &stderr, tc.clientN).Run()
+		if tc.fail {
+			require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+		} else {
+			require.NoError(t, err, "%v error[%v] stdout[%s] stderr[%s]", tc.args, err, string(stdout.Bytes()), string(stderr.Bytes()))
+		}
+		require.Contains(t, string(stdout.Bytes()), tc.output)
+	}
+}
+
+// startJob starts a job and returns its UID.
+func startJob(t *testing.T, args []string, clientN int) string {
+	var stdout, stderr bytes.Buffer
+
+	err := getClnCmd(args, &stdout, &stderr, clientN).Run()
+	txt := string(stdout.Bytes())
+	require.NoError(t, err, "start error[%v] stdout[%s] stderr[%s]", err, txt, string(stderr.Bytes()))
+
+	var uid string
+	if indx := strings.Index(txt, "Process UID:"); indx != -1 {
+		uid = strings.TrimSpace(txt[(indx + 12):])
+	}
+	require.NotEmpty(t, uid, "no uid in stdout[%s]", txt)
+	return uid
+}
+
+// jobOutput starts a job and returns its output once it terminates.
+func jobOutput(t *testing.T, args []string, clientN int) string {
+	var stdout, stderr bytes.Buffer
+
+	uid := startJob(t, args, clientN)
+	err := getClnCmd([]string{"stream", uid}, &stdout, &stderr, clientN).Run()
+	require.NoError(t, err, "stream error[%v] stdout[%s] stderr[%s]", err, string(stdout.Bytes()), string(stderr.Bytes()))
+	return strings.TrimSpace(string(stdout.Bytes()))
+}
+
+// waitTimeout is how long the tests wait for a job to reach a state
+const waitTimeout = 10 * time.Second
+
+// waitStatus polls the status of a job until it is the expected one and returns the status output.
+func waitStatus(t *testing.T, uid string, status string, clientN int) string {
+	return waitFor(t, []string{"status", uid}, "Process status: "+status, clientN)
+}
+
+// waitJobInit waits for the init of a client1 job to join the job cgroup,
+// which the pause, exec and update calls need.
+func waitJobInit(t *testing.T, uid string) {
+	waitFor(t, []string{"exec", uid, "--", "true"}, "", 1)
+}
+
+// waitFor runs the client command until it succeeds with the output containing
+// the expected text, and returns the output. It fails the test after waitTimeout.
+func waitFor(t *testing.T, args []string, output string, clientN int) string {
+	var stdout, stderr bytes.Buffer
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		stdout.Reset()
+		stderr.Reset()
+
+		err := getClnCmd(args, &stdout, &stderr, clientN).Run()
+		txt := strings.TrimSpace(string(stdout.Bytes()))
+		if err == nil && strings.Contains(txt, output) {
+			return txt
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "timed out", "%v: want [%s] error[%v] stdout[%s] stderr[%s]", args, output, err, txt, string(stderr.Bytes()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// parseCert reads a PEM certificate file.
+func parseCert(t *testing.T, path string) *x509.Certificate {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+// loadTestCA returns the certificate and the key of the test CA.
+func loadTestCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	data, err := os.ReadFile(filepath.Join(workDir, "certs", "ca.crt"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	data, err = os.ReadFile(filepath.Join(workDir, "certs", "ca.key"))
+	require.NoError(t, err)
+	block, _ = pem.Decode(data)
+	require.NotNil(t, block)
+	caKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	return ca, caKey.(crypto.Signer)
+}
+
+// newCA creates a self-signed CA certificate and key.
+func newCA(t *testing.T, name string) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return ca, key
+}
+
+// certPEM encodes the certificates in PEM, e.g. for a CA bundle.
+func certPEM(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+// writeCRL writes the CRL of the CA revoking the serial numbers.
+func writeCRL(t *testing.T, path string, ca *x509.Certificate, caKey crypto.Signer, serials ...*big.Int) {
+	revoked := []pkix.RevokedCertificate{}
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	der, err := ca.CreateCRL(rand.Reader, caKey, revoked, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644))
+}
+
+// serverDir returns a server directory with a copy of the test certificates,
+// which the test may rotate without affecting the other servers.
+func serverDir(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "certs"), 0755))
+	for _, name := range []string{"ca.crt", "server.crt", "server.key"} {
+		data, err := os.ReadFile(filepath.Join(workDir, "certs", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "certs", name), data, 0600))
+	}
+	return dir
+}
+
+// checkClientCert calls the server on the local port with the client certificate
+// and checks the call output: "process not found" if the server accepts the certificate,
+// "code = Unavailable" if it refuses it in the handshake.
+func checkClientCert(t *testing.T, port int, crt, key, output string) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := getClnCmd([]string{"-addr", fmt.Sprintf("localhost:%d", port), "stop", "no-such-job"}, &stdout, &stderr, 1)
+	cmd.Env = append(os.Environ(), "CA_CERT=./certs/ca.crt", "CLIENT_CERT="+crt, "CLIENT_KEY="+key)
+	err := cmd.Run()
+	require.Error(t, err, "stdout[%s] stderr[%s]", string(stdout.Bytes()), string(stderr.Bytes()))
+	require.Contains(t, string(stdout.Bytes()), output, "%s: stdout[%s] stderr[%s]", crt, string(stdout.Bytes()), string(stderr.Bytes()))
+}
+
+// startServer starts another server listening on the local port with the extra flags
+// and its own audit log, and stops it at the end of the test. The server runs in dir,
+// which holds its certificates, the work directory if empty.
+func startServer(t *testing.T, dir string, port int, args ...string) {
+	var output bytes.Buffer
+	if len(dir) == 0 {
+		dir = workDir
+	}
+	args = append([]string{"-addr", fmt.Sprintf("localhost:%d", port), "-audit-log", filepath.Join(t.TempDir(), "audit.log"),
+		"-config-dir", filepath.Join(workDir, "config")}, args...)
+	srv := exec.Command(filepath.Join(workDir, "server"), args...)
+	srv.Dir = dir
+	srv.Stdout = &output
+	srv.Stderr = &output
+	require.NoError(t, srv.Start())
+	t.Cleanup(func() {
+		srv.Process.Signal(syscall.SIGTERM)
+		srv.Wait()
+	})
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "server not started", "%v: output[%s]", args, output.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func getClnCmd(args []string, stdout, stderr *bytes.Buffer, clientN int) *exec.Cmd {
 	env := append(os.Environ(), []string{"CA_CERT=./certs/ca.crt", fmt.Sprintf("CLIENT_CERT=./certs/client%d.crt", clientN), fmt.Sprintf("CLIENT_KEY=./certs/client%d.key", clientN)}...)
 	return &exec.Cmd{